@@ -0,0 +1,68 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"gorm.io/gorm"
+)
+
+const maxAttachmentsPerMessage = 10
+
+//Attachments
+
+func (s *Storage) CreateAttachment(a *models.Attachment) error {
+	if !s.IsChatMember(a.ChatID, a.UploaderID) {
+		return ErrNotChatMember
+	}
+	return s.db.Create(a).Error
+}
+
+// GetAttachment loads an attachment userID may download: they must be in its
+// chat, and until it is sent only the uploader can see it.
+func (s *Storage) GetAttachment(userID uint, id uint) (*models.Attachment, error) {
+	a := new(models.Attachment)
+	if err := s.db.Where("id = ?", id).First(a).Error; err != nil {
+		return nil, err
+	}
+	if !s.IsChatMember(a.ChatID, userID) {
+		return nil, ErrNotChatMember
+	}
+	if a.MessageID == nil {
+		if a.UploaderID != userID {
+			return nil, gorm.ErrRecordNotFound
+		}
+		return a, nil
+	}
+	var count int64
+	if err := s.db.Model(&models.Message{}).Where("id = ?", *a.MessageID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return a, nil
+}
+
+// linkAttachments attaches msg.AttachmentIDs to msg. Each must have been
+// uploaded by the sender into the same chat and not be used yet.
+func linkAttachments(tx *gorm.DB, msg *models.Message) error {
+	ids := uniqueIDs(msg.AttachmentIDs, 0)
+	if len(ids) == 0 {
+		return nil
+	}
+	if len(ids) > maxAttachmentsPerMessage {
+		return errors.New("too many attachments")
+	}
+	res := tx.Model(&models.Attachment{}).
+		Where("id IN ? AND uploader_id = ? AND chat_id = ? AND message_id IS NULL", ids, msg.SenderID, msg.ChatID).
+		Update("message_id", msg.ID)
+	if res.Error != nil {
+		return res.Error
+	}
+	if int(res.RowsAffected) != len(ids) {
+		return errors.New("invalid attachment")
+	}
+	msg.Attachments = make([]*models.Attachment, 0, len(ids))
+	return tx.Where("message_id = ?", msg.ID).Find(&msg.Attachments).Error
+}
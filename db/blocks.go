@@ -0,0 +1,156 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrBlocked = errors.New("you cannot message this user")
+
+//Blocking
+
+// BlockUser blocks blockedID for blockerID. It also ends their friendship,
+// cancels pending friend requests between them and hides their 1:1 chat
+// from the blocker's chat list.
+func (s *Storage) BlockUser(blockerID uint, blockedID uint) error {
+	if blockerID == blockedID {
+		return errors.New("you cannot block yourself")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ?", blockedID).First(&models.User{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Block{
+			BlockerID: blockerID,
+			BlockedID: blockedID,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM user_friends WHERE (user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)",
+			blockerID, blockedID, blockedID, blockerID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.FriendRequest{}).
+			Where("((from_id = ? AND to_id = ?) OR (from_id = ? AND to_id = ?)) AND status = ?",
+				blockerID, blockedID, blockedID, blockerID, models.RequestPending).
+			Updates(map[string]any{"status": models.RequestCancelled, "responded_at": time.Now()}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.ChatMember{}).
+			Where("user_id = ? AND chat_id IN (?)", blockerID, directChat(tx, blockerID, blockedID)).
+			Update("hidden_at", time.Now()).Error
+	})
+}
+
+// UnblockUser lifts a block and brings the 1:1 chat back into view. The
+// friendship is not restored.
+func (s *Storage) UnblockUser(blockerID uint, blockedID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("blocker_id = ? AND blocked_id = ?", blockerID, blockedID).Delete(&models.Block{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.ChatMember{}).
+			Where("user_id = ? AND chat_id IN (?)", blockerID, directChat(tx, blockerID, blockedID)).
+			Update("hidden_at", nil).Error
+	})
+}
+
+// directChat is a subquery for the 1:1 chat between two users.
+func directChat(tx *gorm.DB, a uint, b uint) *gorm.DB {
+	return tx.Session(&gorm.Session{NewDB: true}).Table("chats").
+		Select("chats.id").
+		Joins("JOIN user_chats uc1 ON uc1.chat_id = chats.id AND uc1.user_id = ?", a).
+		Joins("JOIN user_chats uc2 ON uc2.chat_id = chats.id AND uc2.user_id = ?", b).
+		Where("chats.is_group = ? AND chats.deleted_at IS NULL", false)
+}
+
+func (s *Storage) GetBlockedUsers(blockerID uint) ([]*models.PublicProfile, error) {
+	profiles := make([]*models.PublicProfile, 0)
+	if err := s.db.Model(&models.User{}).
+		Select("users.id, users.name, users.username, users.pfp").
+		Joins("JOIN blocks b ON b.blocked_id = users.id AND b.blocker_id = ?", blockerID).
+		Order("b.created_at DESC").
+		Scan(&profiles).Error; err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// IsBlockedEither reports whether either user has blocked the other.
+func (s *Storage) IsBlockedEither(a uint, b uint) bool {
+	var count int64
+	if err := s.db.Model(&models.Block{}).
+		Where("(blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)", a, b, b, a).
+		Count(&count).Error; err != nil {
+		return false
+	}
+	return count > 0
+}
+
+// BlockedAmong returns the users in others that have a block in either
+// direction with userID.
+func (s *Storage) BlockedAmong(userID uint, others []uint) (map[uint]bool, error) {
+	blocked := make(map[uint]bool)
+	if len(others) == 0 {
+		return blocked, nil
+	}
+	blocks := make([]*models.Block, 0)
+	if err := s.db.
+		Where("(blocker_id = ? AND blocked_id IN ?) OR (blocked_id = ? AND blocker_id IN ?)", userID, others, userID, others).
+		Find(&blocks).Error; err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		if b.BlockerID == userID {
+			blocked[b.BlockedID] = true
+		} else {
+			blocked[b.BlockerID] = true
+		}
+	}
+	return blocked, nil
+}
+
+//Muting
+
+// MuteChat mutes chatID for userID until the given time, or indefinitely
+// when until is nil.
+func (s *Storage) MuteChat(chatID uint, userID uint, until *time.Time) error {
+	if until != nil && !until.After(time.Now()) {
+		return errors.New("mute expiry must be in the future")
+	}
+	res := s.db.Model(&models.ChatMember{}).
+		Where("chat_id = ? AND user_id = ?", chatID, userID).
+		Updates(map[string]any{"muted": true, "muted_until": until})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotChatMember
+	}
+	return nil
+}
+
+func (s *Storage) UnmuteChat(chatID uint, userID uint) error {
+	res := s.db.Model(&models.ChatMember{}).
+		Where("chat_id = ? AND user_id = ?", chatID, userID).
+		Updates(map[string]any{"muted": false, "muted_until": nil})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotChatMember
+	}
+	return nil
+}
+
+func (s *Storage) IsChatMuted(chatID uint, userID uint) bool {
+	member := new(models.ChatMember)
+	if err := s.db.Where("chat_id = ? AND user_id = ?", chatID, userID).First(member).Error; err != nil {
+		return false
+	}
+	return member.IsMuted(time.Now())
+}
@@ -4,7 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/mail"
 	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/SourishBeast7/Glooo/db/models"
 	"golang.org/x/crypto/bcrypt"
@@ -14,8 +19,15 @@ import (
 
 type Storage struct {
 	db *gorm.DB
+	// editWindow is how long after sending a message its sender may still
+	// edit it or delete it for everyone.
+	editWindow time.Duration
+	// trigram is set once pg_trgm is available for fuzzy user search.
+	trigram bool
 }
 
+const defaultEditWindow = 15 * time.Minute
+
 type Response map[string]any
 
 func NewStorage() *Storage {
@@ -26,15 +38,79 @@ func NewStorage() *Storage {
 		log.Printf("%v", err)
 		return nil
 	}
+	// user_chats carries per-member state, so both sides of the many2many
+	// have to go through the ChatMember model.
+	if err := db.SetupJoinTable(&models.User{}, "Chats", &models.ChatMember{}); err != nil {
+		log.Printf("%v", err)
+		return nil
+	}
+	if err := db.SetupJoinTable(&models.Chat{}, "Users", &models.ChatMember{}); err != nil {
+		log.Printf("%v", err)
+		return nil
+	}
+	editWindow := defaultEditWindow
+	if v := os.Getenv("MESSAGE_EDIT_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Printf("invalid MESSAGE_EDIT_WINDOW %q: %v", v, err)
+		} else {
+			editWindow = d
+		}
+	}
 	return &Storage{
-		db: db,
+		db:         db,
+		editWindow: editWindow,
 	}
 }
 
 func (s *Storage) Init() error {
-	if err := s.db.AutoMigrate(&models.User{}, &models.Chat{}, &models.Message{}, &models.FriendRequest{}); err != nil {
+	hadVerification := !s.db.Migrator().HasTable(&models.User{}) || s.db.Migrator().HasColumn(&models.User{}, "EmailVerifiedAt")
+	if err := s.db.AutoMigrate(
+		&models.User{},
+		&models.Chat{},
+		&models.ChatMember{},
+		&models.Message{},
+		&models.MessageReceipt{},
+		&models.MessageEdit{},
+		&models.MessageHide{},
+		&models.Reaction{},
+		&models.Attachment{},
+		&models.Block{},
+		&models.FriendRequest{},
+		&models.Notification{},
+		&models.NotificationSettings{},
+		&models.RefreshToken{},
+		&models.UserToken{},
+		&models.UserIdentity{},
+		&models.RecoveryCode{},
+		&models.Presence{},
+	); err != nil {
+		return err
+	}
+	if !hadVerification {
+		// Accounts from before email verification existed keep full access.
+		if err := s.db.Exec("UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL").Error; err != nil {
+			return err
+		}
+	}
+
+	// Emails are stored lower-cased. Older rows that would collide with an
+	// existing lower-case address are left alone rather than failing startup.
+	if res := s.db.Exec(`UPDATE users SET email = lower(email) WHERE email <> lower(email)
+		AND NOT EXISTS (SELECT 1 FROM users u WHERE u.email = lower(users.email))`); res.Error != nil {
+		return res.Error
+	} else if res.RowsAffected > 0 {
+		log.Printf("lower-cased %d stored email addresses", res.RowsAffected)
+	}
+
+	// Keyset pagination in GetMessages walks this index.
+	if err := s.db.Exec("CREATE INDEX IF NOT EXISTS idx_messages_chat_created_id ON messages (chat_id, created_at, id)").Error; err != nil {
 		return err
 	}
+	if err := s.migrateMessageSearch(); err != nil {
+		return err
+	}
+	s.migrateUserSearch()
 
 	log.Println("✅ Database migrated")
 	return nil
@@ -42,16 +118,46 @@ func (s *Storage) Init() error {
 
 //User
 
+const (
+	minPasswordLength = 8
+	// bcrypt cannot hash more than 72 bytes.
+	maxPasswordLength = 72
+)
+
+var ErrWeakPassword = fmt.Errorf("password must be between %d and %d characters", minPasswordLength, maxPasswordLength)
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return "", ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
 func (s *Storage) CreateUser(user *models.User) error {
+	email, err := NormalizeEmail(user.Email)
+	if err != nil {
+		return err
+	}
+	user.Email = email
 	u := new(models.User)
 	if err := s.db.Where("email = ?", user.Email).First(u).Error; err == nil {
 		return errors.New("user already exists")
 	}
-	pass, err := bcrypt.GenerateFromPassword([]byte(user.Password), 10)
+	if user.Username != nil {
+		username, err := s.availableUsername(*user.Username, 0)
+		if err != nil {
+			return err
+		}
+		user.Username = &username
+	}
+	user.Password, err = hashPassword(user.Password)
 	if err != nil {
 		return err
 	}
-	user.Password = string(pass)
 	if err := s.db.Model(&models.User{}).Create(user).Error; err != nil {
 		return err
 	}
@@ -59,6 +165,10 @@ func (s *Storage) CreateUser(user *models.User) error {
 }
 
 func (s *Storage) AuthenticateUser(email string, password string) (*models.User, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
 	user := new(models.User)
 	if err := s.db.Preload("Chats").Preload("Friends").Model(&models.User{}).Where("email = ?", email).Find(user).Error; err != nil {
 		return nil, err
@@ -70,6 +180,10 @@ func (s *Storage) AuthenticateUser(email string, password string) (*models.User,
 }
 
 func (s *Storage) FindUserByEmailGorm(email string) (*models.User, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
 	u := new(models.User)
 	if err := s.db.Where("email = ?", email).Find(u).Error; err != nil {
 		return nil, err
@@ -77,38 +191,111 @@ func (s *Storage) FindUserByEmailGorm(email string) (*models.User, error) {
 	return u, nil
 }
 
-func (s *Storage) FindUsersUsingSubstring(id uint, str string) ([]*models.User, error) {
-	users := make([]*models.User, 0)
+var (
+	ErrEmailTaken   = errors.New("email address is already in use")
+	ErrInvalidEmail = errors.New("invalid email address")
+)
+
+// NormalizeEmail checks that email is a bare address, trims and lower-cases
+// it. Every lookup by email goes through it, since that is how it is stored.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+func emailAvailable(tx *gorm.DB, email string, userID uint) error {
+	var count int64
+	if err := tx.Model(&models.User{}).Where("email = ? AND id <> ?", email, userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+func (s *Storage) UpdateProfile(userID uint, update *models.ProfileUpdate) (*models.User, error) {
+	fields := make(map[string]any)
+	if update.Name != nil {
+		name := strings.TrimSpace(*update.Name)
+		if name == "" || utf8.RuneCountInString(name) > 64 {
+			return nil, errors.New("name must be between 1 and 64 characters")
+		}
+		fields["name"] = name
+	}
+	if update.Pfp != nil {
+		fields["pfp"] = *update.Pfp
+	}
+	if len(fields) > 0 {
+		if err := s.db.Model(&models.User{}).Where("id = ?", userID).Updates(fields).Error; err != nil {
+			return nil, err
+		}
+	}
 	user := new(models.User)
-	if err := s.db.Model(&models.User{}).Where("id = ?", id).First(user).Error; err != nil {
+	if err := s.db.Where("id = ?", userID).First(user).Error; err != nil {
 		return nil, err
 	}
-	if err := s.db.Model(&models.User{}).Where("email LIKE ?", "%"+str+"%").Find(&users).Error; err != nil {
+	return user, nil
+}
+
+// checkPassword loads the user and compares password with their hash.
+func (s *Storage) checkPassword(userID uint, password string) (*models.User, error) {
+	user := new(models.User)
+	if err := s.db.Where("id = ?", userID).First(user).Error; err != nil {
 		return nil, err
 	}
-	for i, v := range users {
-		if v.Email == user.Email {
-			return append(users[:i], users[i+1:]...), nil
-		}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return nil, errors.New("current password is incorrect")
 	}
-	return nil, errors.New("an error occurred")
+	return user, nil
 }
 
-func (s *Storage) UpdateUser(user *models.UpdateUser) (bool, error) {
-	allowedFields := map[string]bool{
-		"Name":     true,
-		"Email":    true,
-		"Pfp":      true,
-		"Password": true,
-	}
-	if !allowedFields[user.Field] {
-		return false, errors.New("field update not allowed")
+// ConfirmPassword checks password for sensitive changes by a signed in user.
+func (s *Storage) ConfirmPassword(userID uint, password string) error {
+	_, err := s.checkPassword(userID, password)
+	return err
+}
+
+// ChangePassword replaces the user's password after checking the current
+// one, and signs out every session except keepFamily.
+func (s *Storage) ChangePassword(userID uint, current string, next string, keepFamily string) error {
+	if _, err := s.checkPassword(userID, current); err != nil {
+		return err
 	}
-	if err := s.db.Model(&models.User{}).Where("email = ?", user.Email).Update(user.Field, user.Value).Error; err != nil {
-		return false, err
+	hash, err := hashPassword(next)
+	if err != nil {
+		return err
 	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).Update("password", hash).Error; err != nil {
+			return err
+		}
+		return revokeOtherSessions(tx, userID, keepFamily)
+	})
+}
 
-	return true, nil
+// PrepareEmailChange checks that the user may move to email: the password
+// must match and the address must be free.
+func (s *Storage) PrepareEmailChange(userID uint, password string, email string) (*models.User, string, error) {
+	user, err := s.checkPassword(userID, password)
+	if err != nil {
+		return nil, "", err
+	}
+	email, err = NormalizeEmail(email)
+	if err != nil {
+		return nil, "", err
+	}
+	if email == user.Email {
+		return nil, "", errors.New("that is already your email address")
+	}
+	if err := emailAvailable(s.db, email, userID); err != nil {
+		return nil, "", err
+	}
+	return user, email, nil
 }
 
 func (s *Storage) FindUserById(id uint) (*models.User, error) {
@@ -121,94 +308,222 @@ func (s *Storage) FindUserById(id uint) (*models.User, error) {
 
 //Friends
 
+var (
+	ErrFriendRequestNotFound = errors.New("friend request not found")
+	ErrAlreadyFriends        = errors.New("you are already friends with this user")
+)
+
 func (s *Storage) GetReceivedFriendRequest(uid uint) ([]*models.FriendRequest, error) {
-	user := new(models.User)
-	if err := s.db.Model(&models.User{}).Preload("ReceivedRequests.From").Preload("ReceivedRequests.To").Where("id = ?", uid).First(user).Error; err != nil {
+	requests := make([]*models.FriendRequest, 0)
+	if err := s.db.Preload("From").Preload("To").
+		Where("to_id = ? AND status = ?", uid, models.RequestPending).
+		Order("created_at DESC").
+		Find(&requests).Error; err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+func (s *Storage) GetSentFriendRequests(uid uint) ([]*models.FriendRequest, error) {
+	requests := make([]*models.FriendRequest, 0)
+	if err := s.db.Preload("To").
+		Where("from_id = ? AND status = ?", uid, models.RequestPending).
+		Order("created_at DESC").
+		Find(&requests).Error; err != nil {
 		return nil, err
 	}
-	return user.ReceivedRequests, nil
+	return requests, nil
 }
 
-func (s *Storage) CheckRequestExists(uid uint, friendEmail string) bool {
+// pendingRequest finds the pending request sent by fromID to toID.
+func pendingRequest(tx *gorm.DB, fromID uint, toID uint) (*models.FriendRequest, error) {
+	req := new(models.FriendRequest)
+	if err := tx.Preload("From").Preload("To").
+		Where("from_id = ? AND to_id = ? AND status = ?", fromID, toID, models.RequestPending).
+		First(req).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrFriendRequestNotFound
+		}
+		return nil, err
+	}
+	return req, nil
+}
+
+// SendFriendRequest sends a request from userid to the user with friendEmail.
+// If that user already has a pending request out to userid, it is accepted
+// instead and that request is returned.
+func (s *Storage) SendFriendRequest(userid uint, friendEmail string) (*models.FriendRequest, error) {
+	friendEmail, err := NormalizeEmail(friendEmail)
+	if err != nil {
+		return nil, err
+	}
 	friend := new(models.User)
 	if err := s.db.Model(&models.User{}).Where("email = ?", friendEmail).First(friend).Error; err != nil {
-		return false
-	}
-	if err := s.db.Model(&models.FriendRequest{}).Where("from_id = ? and to_id = ?", uid, friend.ID).First(nil).Error; err != nil {
-		return false
+		log.Printf("friend not found: %v", err)
+		return nil, err
 	}
-	return true
+	return s.sendFriendRequest(userid, friend)
 }
 
-func (s *Storage) SendFriendRequest(userid uint, friendEmail string) error {
-	if s.CheckRequestExists(userid, friendEmail) {
-		return fmt.Errorf("user %s has already sent you a friend request", friendEmail)
+// SendFriendRequestTo is SendFriendRequest for a user found by id, such as a
+// search result, whose email the caller does not know.
+func (s *Storage) SendFriendRequestTo(userid uint, friendID uint) (*models.FriendRequest, error) {
+	friend := new(models.User)
+	if err := s.db.Model(&models.User{}).Where("id = ?", friendID).First(friend).Error; err != nil {
+		log.Printf("friend not found: %v", err)
+		return nil, err
 	}
-	var user, friend models.User
+	return s.sendFriendRequest(userid, friend)
+}
+
+func (s *Storage) sendFriendRequest(userid uint, friend *models.User) (*models.FriendRequest, error) {
+	var user models.User
 
 	// Find user
 	if err := s.db.Model(&models.User{}).Where("id = ?", userid).First(&user).Error; err != nil {
 		log.Printf("user not found: %v", err)
-		return err
-	}
-
-	// Find friend
-	if err := s.db.Model(&models.User{}).Where("email = ?", friendEmail).First(&friend).Error; err != nil {
-		log.Printf("friend not found: %v", err)
-		return err
+		return nil, err
 	}
 	if userid == friend.ID {
-		return errors.New("user cannot add themselves as friend")
-	}
-	if err := s.db.Create(&models.FriendRequest{
-		From:   &user,
-		FromID: user.ID,
-		ToID:   friend.ID,
-		Status: "pending",
-		To:     &friend,
-	}).Error; err != nil {
-		return err
+		return nil, errors.New("user cannot add themselves as friend")
 	}
-	return nil
-}
-
-func (s *Storage) HandleFriendRequest(req *models.HandleRequest) error {
-	tx := s.db.Begin()
-	newReq := new(models.FriendRequest)
-	if err := tx.Model(&models.FriendRequest{}).Preload("From").Preload("To").Where("to_id = ? and from_id = ?", req.ToID, req.FromID).First(newReq).Error; err != nil {
-		return err
+	if s.IsBlockedEither(userid, friend.ID) {
+		return nil, errors.New("cannot send a friend request to this user")
 	}
-	if req.Action == "decline" {
-		if err := tx.Model(&models.FriendRequest{}).Delete(newReq).Error; err != nil {
-			tx.Rollback()
+	var req *models.FriendRequest
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if ok, err := s.areFriends(tx, userid, []uint{friend.ID}); err != nil {
 			return err
+		} else if ok {
+			return ErrAlreadyFriends
 		}
-		log.Println("Request Declined")
-		tx.Commit()
-		return nil
-	}
-	if req.Action == "accept" {
-		if newReq.Status != "pending" {
-			return errors.New("Request is " + newReq.Status)
+		if _, err := pendingRequest(tx, userid, friend.ID); err == nil {
+			return fmt.Errorf("you have already sent %s a friend request", friend.Name)
+		} else if !errors.Is(err, ErrFriendRequestNotFound) {
+			return err
 		}
-
-		user, friend := newReq.From, newReq.To
-		if err := tx.Model(friend).Association("Friends").Append(user); err != nil {
-			tx.Rollback()
+		reverse, err := pendingRequest(tx, friend.ID, userid)
+		if err == nil {
+			req = reverse
+			return acceptFriendRequest(tx, reverse)
+		}
+		if !errors.Is(err, ErrFriendRequestNotFound) {
 			return err
 		}
-		if err := tx.Model(user).Association("Friends").Append(friend); err != nil {
-			tx.Rollback()
+		req = &models.FriendRequest{
+			FromID: user.ID,
+			ToID:   friend.ID,
+			Status: models.RequestPending,
+		}
+		return tx.Create(req).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// HandleFriendRequest accepts or declines the pending request from req.FromID.
+// req.ToID must be the caller, since only the recipient may answer a request.
+func (s *Storage) HandleFriendRequest(req *models.HandleRequest) (*models.FriendRequest, error) {
+	if req.ToID == 0 {
+		return nil, errors.New("only the recipient can answer a friend request")
+	}
+	var answered *models.FriendRequest
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		pending, err := pendingRequest(tx, req.FromID, req.ToID)
+		if err != nil {
 			return err
 		}
-		tx.Commit()
-		// Creating chat for friends
-		if err := s.CreateChat("", user, friend); err != nil {
+		if pending.ToID != req.ToID {
+			return errors.New("only the recipient can answer a friend request")
+		}
+		answered = pending
+		switch req.Action {
+		case "accept":
+			return acceptFriendRequest(tx, pending)
+		case "decline":
+			return respondToRequest(tx, pending, models.RequestRejected)
+		}
+		return errors.New("action unrecognised")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return answered, nil
+}
+
+func respondToRequest(tx *gorm.DB, req *models.FriendRequest, status string) error {
+	now := time.Now()
+	req.Status, req.RespondedAt = status, &now
+	return tx.Model(req).Select("status", "responded_at").Updates(req).Error
+}
+
+// acceptFriendRequest marks req accepted, links both users as friends and
+// makes sure they share a 1:1 chat, reusing one from an earlier friendship.
+func acceptFriendRequest(tx *gorm.DB, req *models.FriendRequest) error {
+	if err := respondToRequest(tx, req, models.RequestAccepted); err != nil {
+		return err
+	}
+	if err := tx.Exec("INSERT INTO user_friends (user_id, friend_id) VALUES (?, ?), (?, ?) ON CONFLICT DO NOTHING",
+		req.FromID, req.ToID, req.ToID, req.FromID).Error; err != nil {
+		return err
+	}
+
+	var chatIDs []uint
+	if err := directChat(tx, req.FromID, req.ToID).Pluck("chats.id", &chatIDs).Error; err != nil {
+		return err
+	}
+	if len(chatIDs) > 0 {
+		return tx.Model(&models.ChatMember{}).
+			Where("chat_id = ? AND user_id IN ?", chatIDs[0], []uint{req.FromID, req.ToID}).
+			Update("hidden_at", nil).Error
+	}
+	chat := &models.Chat{Name: "user"}
+	if err := tx.Create(chat).Error; err != nil {
+		return err
+	}
+	return tx.Create([]*models.ChatMember{
+		{ChatID: chat.ID, UserID: req.FromID, Role: models.RoleMember},
+		{ChatID: chat.ID, UserID: req.ToID, Role: models.RoleMember},
+	}).Error
+}
+
+// CancelFriendRequest withdraws the pending request requestID, which userid
+// must have sent.
+func (s *Storage) CancelFriendRequest(userid uint, requestID uint) (*models.FriendRequest, error) {
+	var cancelled *models.FriendRequest
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		pending := new(models.FriendRequest)
+		if err := tx.Preload("From").Preload("To").
+			Where("id = ? AND from_id = ? AND status = ?", requestID, userid, models.RequestPending).
+			First(pending).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrFriendRequestNotFound
+			}
 			return err
 		}
-		return nil
+		cancelled = pending
+		return respondToRequest(tx, pending, models.RequestCancelled)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return errors.New("action unrecognised")
+	return cancelled, nil
+}
+
+// Unfriend ends the friendship in both directions. The 1:1 chat and its
+// history are kept.
+func (s *Storage) Unfriend(userid uint, friendID uint) error {
+	res := s.db.Exec("DELETE FROM user_friends WHERE (user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)",
+		userid, friendID, friendID, userid)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("you are not friends with this user")
+	}
+	return nil
 }
 
 func (s *Storage) GetFriends(user_id uint) ([]*models.User, error) {
@@ -219,11 +534,23 @@ func (s *Storage) GetFriends(user_id uint) ([]*models.User, error) {
 	return user.Friends, nil
 }
 
+func (s *Storage) FriendIDs(user_id uint) ([]uint, error) {
+	ids := make([]uint, 0)
+	if err := s.db.Table("user_friends").Where("user_id = ?", user_id).Pluck("friend_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (s *Storage) UpdateLastSeen(user_id uint, at time.Time) error {
+	return s.db.Model(&models.User{}).Where("id = ?", user_id).Update("last_seen", at).Error
+}
+
 //Chats
 
 func (s *Storage) FindChatByChatID(id uint) (*models.Chat, error) {
 	chat := new(models.Chat)
-	if err := s.db.Model(&models.Chat{}).Preload("Users").Preload("Messages").Where("id = ?", id).First(chat).Error; err != nil {
+	if err := s.db.Model(&models.Chat{}).Preload("Users").Where("id = ?", id).First(chat).Error; err != nil {
 		return nil, err
 	}
 	return chat, nil
@@ -244,41 +571,264 @@ func (s *Storage) CreateChat(name string, users ...*models.User) error {
 	return nil
 }
 
-func (s *Storage) GetChatsByUserId(user_id uint) ([]*models.Chat, error) {
+// GetChatsByUserId returns the user's chats with their unread count and last
+// message, most recently active first.
+func (s *Storage) GetChatsByUserId(user_id uint) ([]*models.ChatSummary, error) {
 	user := models.User{}
-	if err := s.db.Preload("Chats").Where("id = ?", user_id).First(&user).Error; err != nil {
+	if err := s.db.Preload("Chats.Users").Where("id = ?", user_id).First(&user).Error; err != nil {
 		return nil, err
 	}
-	return user.Chats, nil
-}
+	summaries := make([]*models.ChatSummary, 0, len(user.Chats))
+	if len(user.Chats) == 0 {
+		return summaries, nil
+	}
+	chatIDs := make([]uint, 0, len(user.Chats))
+	for _, chat := range user.Chats {
+		chatIDs = append(chatIDs, chat.ID)
+	}
 
-// Messages
+	members := make([]*models.ChatMember, 0)
+	if err := s.db.Where("user_id = ? AND chat_id IN ?", user_id, chatIDs).Find(&members).Error; err != nil {
+		return nil, err
+	}
+	membership := make(map[uint]*models.ChatMember, len(members))
+	for _, m := range members {
+		membership[m.ChatID] = m
+	}
+
+	var counts []struct {
+		ChatID uint
+		Unread int64
+	}
+	if err := s.db.Table("messages").
+		Select("messages.chat_id, COUNT(*) AS unread").
+		Joins("JOIN user_chats uc ON uc.chat_id = messages.chat_id AND uc.user_id = ?", user_id).
+		Where("messages.chat_id IN ? AND messages.id > uc.last_read_message_id AND messages.sender_id <> ? AND messages.deleted_at IS NULL", chatIDs, user_id).
+		Group("messages.chat_id").
+		Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	unread := make(map[uint]int64, len(counts))
+	for _, c := range counts {
+		unread[c.ChatID] = c.Unread
+	}
 
-func (s *Storage) GetMessages(chat_id uint) ([]*models.Message, error) {
-	messages := make([]*models.Message, 0)
-	if err := s.db.Model(&models.Message{}).Where("chat_id = ?", chat_id).Order("created_at ASC").Find(&messages).Error; err != nil {
+	latest := make([]*models.Message, 0)
+	if err := s.db.Raw(`SELECT DISTINCT ON (chat_id) * FROM messages
+		WHERE chat_id IN ? AND deleted_at IS NULL
+		ORDER BY chat_id, created_at DESC, id DESC`, chatIDs).Scan(&latest).Error; err != nil {
 		return nil, err
 	}
-	return messages, nil
+	last := make(map[uint]*models.Message, len(latest))
+	for _, m := range latest {
+		last[m.ChatID] = m
+	}
+
+	now := time.Now()
+	for _, chat := range user.Chats {
+		member := membership[chat.ID]
+		if member == nil || member.HiddenAt != nil {
+			continue
+		}
+		summary := &models.ChatSummary{
+			Chat:              chat,
+			LastReadMessageID: member.LastReadMessageID,
+			UnreadCount:       unread[chat.ID],
+			LastMessage:       last[chat.ID],
+			Muted:             member.IsMuted(now),
+		}
+		if summary.Muted {
+			summary.MutedUntil = member.MutedUntil
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return activity(summaries[i]).After(activity(summaries[j]))
+	})
+	return summaries, nil
 }
 
-func (s *Storage) AddMessages(msg *models.Message) (Response, error) {
+func activity(c *models.ChatSummary) time.Time {
+	if c.LastMessage != nil {
+		return c.LastMessage.CreatedAt
+	}
+	return c.CreatedAt
+}
 
-	chat := new(models.Chat)
-	if err := s.db.
-		Joins("JOIN user_chats uc1 ON uc1.chat_id = chats.id AND uc1.user_id = ?", msg.SenderID).
-		Joins("JOIN user_chats uc2 ON uc2.chat_id = chats.id AND uc2.user_id = ?", msg.ReceiverID).
-		Where("is_group = ?", false). // optional: only private chats
-		Find(chat).Error; err != nil {
-		return Response{
-			"msg": "Chat does not exist",
-		}, err
-	}
-	msg.ChatID = chat.ID
-	if err := s.db.Model(&models.Message{}).Create(msg).Error; err != nil {
-		return nil, err
+// MarkChatRead moves userID's read marker in chatID forward to messageID and
+// marks everything up to it as read. It reports false when the marker was
+// already at or past messageID.
+func (s *Storage) MarkChatRead(chatID uint, userID uint, messageID uint) (bool, error) {
+	changed := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := s.chatMember(tx, chatID, userID); err != nil {
+			return err
+		}
+		var count int64
+		if err := tx.Model(&models.Message{}).Where("id = ? AND chat_id = ?", messageID, chatID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return errors.New("message not found in chat")
+		}
+		res := tx.Model(&models.ChatMember{}).
+			Where("chat_id = ? AND user_id = ? AND last_read_message_id < ?", chatID, userID, messageID).
+			Update("last_read_message_id", messageID)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+		changed = true
+		now := time.Now()
+		return tx.Model(&models.MessageReceipt{}).
+			Where("user_id = ? AND status <> ? AND message_id IN (?)", userID, models.DeliveryRead,
+				tx.Model(&models.Message{}).Select("id").Where("chat_id = ? AND id <= ?", chatID, messageID)).
+			Updates(map[string]any{
+				"status":       models.DeliveryRead,
+				"read_at":      now,
+				"delivered_at": gorm.Expr("COALESCE(delivered_at, ?)", now),
+			}).Error
+	})
+	return changed, err
+}
+
+// Messages
+
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 100
+)
+
+// GetMessages returns one page of a chat's messages in ascending order. With
+// no cursor it returns the newest page; Before and After are message IDs to
+// page backwards or forwards from. The returned cursor is the message ID to
+// pass as the same parameter for the next page, or 0 when there is none.
+func (s *Storage) GetMessages(userID uint, q *models.MessageQuery) ([]*models.Message, uint, error) {
+	if q.Before != 0 && q.After != 0 {
+		return nil, 0, errors.New("before and after cannot be combined")
+	}
+	if !s.IsChatMember(q.ChatID, userID) {
+		return nil, 0, ErrNotChatMember
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultMessagePageSize
+	}
+	if limit > maxMessagePageSize {
+		limit = maxMessagePageSize
+	}
+
+	query := s.db.Model(&models.Message{}).
+		Where("chat_id = ?", q.ChatID).
+		Where("NOT EXISTS (SELECT 1 FROM message_hides mh WHERE mh.message_id = messages.id AND mh.user_id = ?)", userID)
+	forward := q.After != 0
+	if cursorID := q.Before + q.After; cursorID != 0 {
+		cursor := new(models.Message)
+		if err := s.db.Select("id", "created_at").Where("id = ? AND chat_id = ?", cursorID, q.ChatID).First(cursor).Error; err != nil {
+			return nil, 0, errors.New("invalid cursor")
+		}
+		if forward {
+			query = query.Where("(created_at, id) > (?, ?)", cursor.CreatedAt, cursor.ID)
+		} else {
+			query = query.Where("(created_at, id) < (?, ?)", cursor.CreatedAt, cursor.ID)
+		}
+	}
+	if forward {
+		query = query.Order("created_at ASC, id ASC")
+	} else {
+		query = query.Order("created_at DESC, id DESC")
+	}
+
+	messages := make([]*models.Message, 0, limit+1)
+	if err := query.Preload("ReplyTo").Preload("Attachments").Limit(limit + 1).Find(&messages).Error; err != nil {
+		return nil, 0, err
+	}
+	var next uint
+	if len(messages) > limit {
+		messages = messages[:limit]
+		next = messages[limit-1].ID
+	}
+	if !forward {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
 	}
-	return Response{
-		"success": true,
-	}, nil
+	if err := s.attachReactions(userID, messages); err != nil {
+		return nil, 0, err
+	}
+	return messages, next, nil
+}
+
+// AddMessages stores msg in its chat. Group messages must carry a ChatID;
+// 1:1 messages may instead name a ReceiverID and the shared chat is looked up.
+func (s *Storage) AddMessages(msg *models.Message) error {
+	if msg.ChatID == 0 {
+		if msg.ReceiverID == nil {
+			return errors.New("message needs a chat_id or receiver_id")
+		}
+		chat := new(models.Chat)
+		if err := s.db.
+			Joins("JOIN user_chats uc1 ON uc1.chat_id = chats.id AND uc1.user_id = ?", msg.SenderID).
+			Joins("JOIN user_chats uc2 ON uc2.chat_id = chats.id AND uc2.user_id = ?", *msg.ReceiverID).
+			Where("is_group = ?", false).
+			First(chat).Error; err != nil {
+			return errors.New("chat does not exist")
+		}
+		msg.ChatID = chat.ID
+	} else {
+		chat := new(models.Chat)
+		if err := s.db.Select("id", "is_group").Where("id = ?", msg.ChatID).First(chat).Error; err != nil {
+			return errors.New("chat does not exist")
+		}
+		if !s.IsChatMember(msg.ChatID, msg.SenderID) {
+			return ErrNotChatMember
+		}
+		if chat.IsGroup {
+			msg.ReceiverID = nil
+		} else {
+			ids, err := s.ChatMemberIDs(msg.ChatID)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				if id != msg.SenderID {
+					receiver := id
+					msg.ReceiverID = &receiver
+				}
+			}
+		}
+	}
+	if msg.ReceiverID != nil && s.IsBlockedEither(msg.SenderID, *msg.ReceiverID) {
+		return ErrBlocked
+	}
+	if msg.ReplyToID != nil {
+		quoted := new(models.Message)
+		if err := s.db.Where("id = ? AND chat_id = ?", *msg.ReplyToID, msg.ChatID).First(quoted).Error; err != nil {
+			return errors.New("replied message not found in this chat")
+		}
+		msg.ReplyTo = quoted
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Message{}).Omit("ReplyTo").Create(msg).Error; err != nil {
+			return err
+		}
+		if err := linkAttachments(tx, msg); err != nil {
+			return err
+		}
+		// Every other member starts out with the message in the "sent" state.
+		recipients := make([]uint, 0)
+		if err := tx.Model(&models.ChatMember{}).Where("chat_id = ? AND user_id <> ?", msg.ChatID, msg.SenderID).Pluck("user_id", &recipients).Error; err != nil {
+			return err
+		}
+		if len(recipients) == 0 {
+			return nil
+		}
+		receipts := make([]*models.MessageReceipt, 0, len(recipients))
+		for _, id := range recipients {
+			receipts = append(receipts, &models.MessageReceipt{MessageID: msg.ID, UserID: id, Status: models.DeliverySent})
+		}
+		return tx.Create(&receipts).Error
+	})
 }
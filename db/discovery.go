@@ -0,0 +1,158 @@
+package db
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultUserPageSize = 20
+	maxUserPageSize     = 50
+	// similarityThreshold is the pg_trgm similarity a fuzzy match needs.
+	similarityThreshold = 0.3
+)
+
+var (
+	ErrUsernameTaken   = errors.New("username is already taken")
+	ErrInvalidUsername = errors.New("username must be 3-32 characters of letters, digits, '_' or '.'")
+
+	usernamePattern = regexp.MustCompile(`^[a-z0-9_.]{3,32}$`)
+)
+
+//Discovery
+
+// migrateUserSearch enables pg_trgm and indexes names and handles for fuzzy
+// search. Without the extension, SearchUsers falls back to prefix matching.
+func (s *Storage) migrateUserSearch() {
+	if err := s.db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		log.Printf("pg_trgm unavailable, user search is prefix only: %v", err)
+		return
+	}
+	for _, stmt := range []string{
+		"CREATE INDEX IF NOT EXISTS idx_users_name_trgm ON users USING GIN (lower(name) gin_trgm_ops)",
+		"CREATE INDEX IF NOT EXISTS idx_users_username_trgm ON users USING GIN (username gin_trgm_ops)",
+	} {
+		if err := s.db.Exec(stmt).Error; err != nil {
+			log.Printf("user search index: %v", err)
+			return
+		}
+	}
+	s.trigram = true
+}
+
+// NormalizeUsername lower-cases a handle, drops a leading '@' and validates it.
+func NormalizeUsername(username string) (string, error) {
+	username = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(username), "@"))
+	if !usernamePattern.MatchString(username) {
+		return "", ErrInvalidUsername
+	}
+	return username, nil
+}
+
+// availableUsername normalises username and checks nobody but userID has it.
+func (s *Storage) availableUsername(username string, userID uint) (string, error) {
+	username, err := NormalizeUsername(username)
+	if err != nil {
+		return "", err
+	}
+	var count int64
+	if err := s.db.Model(&models.User{}).Where("username = ? AND id <> ?", username, userID).Count(&count).Error; err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return "", ErrUsernameTaken
+	}
+	return username, nil
+}
+
+func (s *Storage) SetUsername(userID uint, username string) (string, error) {
+	username, err := s.availableUsername(username, userID)
+	if err != nil {
+		return "", err
+	}
+	if err := s.db.Model(&models.User{}).Where("id = ?", userID).Update("username", username).Error; err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+func (s *Storage) SetDiscoverability(userID uint, setting string) error {
+	switch setting {
+	case models.DiscoverEveryone, models.DiscoverFriendsOfFriends, models.DiscoverNobody:
+	default:
+		return errors.New("discoverability must be everyone, friends_of_friends or nobody")
+	}
+	return s.db.Model(&models.User{}).Where("id = ?", userID).Update("discoverability", setting).Error
+}
+
+// orderBy builds an ORDER BY expression with bound parameters.
+func orderBy(sql string, vars ...any) clause.OrderBy {
+	return clause.OrderBy{Expression: clause.Expr{SQL: sql, Vars: vars, WithoutParentheses: true}}
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// SearchUsers finds users by name or handle prefix, plus trigram similarity
+// when available, that are discoverable by callerID. Users blocked either
+// way are left out. page starts at 1. It reports whether there are more
+// results after this page.
+func (s *Storage) SearchUsers(callerID uint, term string, page int, limit int) ([]*models.PublicProfile, bool, error) {
+	term = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(term), "@"))
+	if term == "" {
+		return nil, false, errors.New("search term is required")
+	}
+	if limit <= 0 {
+		limit = defaultUserPageSize
+	}
+	if limit > maxUserPageSize {
+		limit = maxUserPageSize
+	}
+	page = max(page, 1)
+	prefix := escapeLike(term) + "%"
+
+	query := s.db.Model(&models.User{}).
+		Select("users.id, users.name, users.username, users.pfp").
+		Where("users.id <> ?", callerID)
+	if s.trigram {
+		query = query.
+			Where(`(lower(users.name) LIKE ? OR lower(users.name) LIKE ? OR users.username LIKE ?
+				OR similarity(lower(users.name), ?) > ? OR similarity(users.username, ?) > ?)`,
+				prefix, "% "+prefix, prefix, term, similarityThreshold, term, similarityThreshold).
+			Order(orderBy("coalesce(users.username, '') LIKE ? DESC", prefix)).
+			Order(orderBy("lower(users.name) LIKE ? DESC", prefix)).
+			Order(orderBy("GREATEST(similarity(lower(users.name), ?), similarity(coalesce(users.username, ''), ?)) DESC", term, term))
+	} else {
+		query = query.
+			Where("(lower(users.name) LIKE ? OR lower(users.name) LIKE ? OR users.username LIKE ?)", prefix, "% "+prefix, prefix).
+			Order(orderBy("coalesce(users.username, '') LIKE ? DESC", prefix))
+	}
+	query = query.Where(`users.discoverability = ? OR (users.discoverability = ? AND (
+			EXISTS (SELECT 1 FROM user_friends f WHERE f.user_id = ? AND f.friend_id = users.id)
+			OR EXISTS (SELECT 1 FROM user_friends f1 JOIN user_friends f2 ON f2.user_id = f1.friend_id
+				WHERE f1.user_id = ? AND f2.friend_id = users.id)))`,
+		models.DiscoverEveryone, models.DiscoverFriendsOfFriends, callerID, callerID)
+	query = query.Where(`NOT EXISTS (SELECT 1 FROM blocks b
+			WHERE (b.blocker_id = ? AND b.blocked_id = users.id) OR (b.blocker_id = users.id AND b.blocked_id = ?))`,
+		callerID, callerID)
+
+	profiles := make([]*models.PublicProfile, 0, limit+1)
+	if err := query.
+		Order("users.id ASC").
+		Limit(limit + 1).
+		Offset((page - 1) * limit).
+		Scan(&profiles).Error; err != nil {
+		return nil, false, err
+	}
+	more := len(profiles) > limit
+	if more {
+		profiles = profiles[:limit]
+	}
+	return profiles, more, nil
+}
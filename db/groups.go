@@ -0,0 +1,293 @@
+package db
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNotChatMember = errors.New("user is not a member of this chat")
+	ErrNotGroup      = errors.New("chat is not a group")
+	ErrForbidden     = errors.New("not allowed")
+)
+
+const maxGroupNameLength = 100
+
+//Chat Members
+
+func (s *Storage) IsChatMember(chatID uint, userID uint) bool {
+	var count int64
+	if err := s.db.Model(&models.ChatMember{}).Where("chat_id = ? AND user_id = ?", chatID, userID).Count(&count).Error; err != nil {
+		return false
+	}
+	return count > 0
+}
+
+func (s *Storage) ChatMemberIDs(chatID uint) ([]uint, error) {
+	ids := make([]uint, 0)
+	if err := s.db.Model(&models.ChatMember{}).Where("chat_id = ?", chatID).Pluck("user_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (s *Storage) GetChatMembers(chatID uint) ([]*models.ChatMember, error) {
+	members := make([]*models.ChatMember, 0)
+	if err := s.db.Preload("User").Where("chat_id = ?", chatID).Order("created_at ASC").Find(&members).Error; err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (s *Storage) chatMember(tx *gorm.DB, chatID uint, userID uint) (*models.ChatMember, error) {
+	member := new(models.ChatMember)
+	if err := tx.Where("chat_id = ? AND user_id = ?", chatID, userID).First(member).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotChatMember
+		}
+		return nil, err
+	}
+	return member, nil
+}
+
+// groupMember loads userID's membership in chatID and checks that the chat is a group.
+func (s *Storage) groupMember(tx *gorm.DB, chatID uint, userID uint) (*models.ChatMember, error) {
+	chat := new(models.Chat)
+	if err := tx.Select("id", "is_group").Where("id = ?", chatID).First(chat).Error; err != nil {
+		return nil, err
+	}
+	if !chat.IsGroup {
+		return nil, ErrNotGroup
+	}
+	return s.chatMember(tx, chatID, userID)
+}
+
+func canManage(role string) bool {
+	return role == models.RoleOwner || role == models.RoleAdmin
+}
+
+func groupName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("group name is required")
+	}
+	if len(name) > maxGroupNameLength {
+		return "", errors.New("group name is too long")
+	}
+	return name, nil
+}
+
+// areFriends reports whether every id in others is a friend of userID.
+func (s *Storage) areFriends(tx *gorm.DB, userID uint, others []uint) (bool, error) {
+	var count int64
+	if err := tx.Table("user_friends").Where("user_id = ? AND friend_id IN ?", userID, others).Distinct("friend_id").Count(&count).Error; err != nil {
+		return false, err
+	}
+	return int(count) == len(others), nil
+}
+
+func uniqueIDs(ids []uint, skip uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	out := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if id == 0 || id == skip || seen[id] {
+			continue
+		}
+		seen[id] = true
+		out = append(out, id)
+	}
+	return out
+}
+
+//Groups
+
+// CreateGroupChat creates a named group owned by ownerID. Members must be
+// friends of the owner.
+func (s *Storage) CreateGroupChat(ownerID uint, name string, memberIDs []uint) (*models.Chat, error) {
+	name, err := groupName(name)
+	if err != nil {
+		return nil, err
+	}
+	memberIDs = uniqueIDs(memberIDs, ownerID)
+	chat := &models.Chat{Name: name, IsGroup: true}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if len(memberIDs) > 0 {
+			ok, err := s.areFriends(tx, ownerID, memberIDs)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errors.New("group members must be your friends")
+			}
+		}
+		if err := tx.Create(chat).Error; err != nil {
+			return err
+		}
+		members := []*models.ChatMember{{ChatID: chat.ID, UserID: ownerID, Role: models.RoleOwner}}
+		for _, id := range memberIDs {
+			members = append(members, &models.ChatMember{ChatID: chat.ID, UserID: id, Role: models.RoleMember})
+		}
+		return tx.Create(&members).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chat, nil
+}
+
+func (s *Storage) AddGroupMembers(chatID uint, actorID uint, userIDs []uint) error {
+	userIDs = uniqueIDs(userIDs, actorID)
+	if len(userIDs) == 0 {
+		return errors.New("no users to add")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		actor, err := s.groupMember(tx, chatID, actorID)
+		if err != nil {
+			return err
+		}
+		if !canManage(actor.Role) {
+			return ErrForbidden
+		}
+		ok, err := s.areFriends(tx, actorID, userIDs)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("you can only add your friends")
+		}
+		existing := make([]uint, 0)
+		if err := tx.Model(&models.ChatMember{}).Where("chat_id = ? AND user_id IN ?", chatID, userIDs).Pluck("user_id", &existing).Error; err != nil {
+			return err
+		}
+		members := make([]*models.ChatMember, 0, len(userIDs))
+		for _, id := range userIDs {
+			if containsID(existing, id) {
+				continue
+			}
+			members = append(members, &models.ChatMember{ChatID: chatID, UserID: id, Role: models.RoleMember})
+		}
+		if len(members) == 0 {
+			return nil
+		}
+		return tx.Create(&members).Error
+	})
+}
+
+func containsID(ids []uint, id uint) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveGroupMember removes userID from the group. Owners can remove anyone,
+// admins only plain members.
+func (s *Storage) RemoveGroupMember(chatID uint, actorID uint, userID uint) error {
+	if actorID == userID {
+		return s.LeaveGroup(chatID, userID)
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		actor, err := s.groupMember(tx, chatID, actorID)
+		if err != nil {
+			return err
+		}
+		target, err := s.chatMember(tx, chatID, userID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case actor.Role == models.RoleOwner:
+		case actor.Role == models.RoleAdmin && target.Role == models.RoleMember:
+		default:
+			return ErrForbidden
+		}
+		return tx.Where("chat_id = ? AND user_id = ?", chatID, userID).Delete(&models.ChatMember{}).Error
+	})
+}
+
+// LeaveGroup removes userID from the group. A leaving owner hands ownership to
+// the longest standing admin, or failing that member; the last one out deletes
+// the group.
+func (s *Storage) LeaveGroup(chatID uint, userID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		member, err := s.groupMember(tx, chatID, userID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("chat_id = ? AND user_id = ?", chatID, userID).Delete(&models.ChatMember{}).Error; err != nil {
+			return err
+		}
+		if member.Role != models.RoleOwner {
+			return nil
+		}
+		successor := new(models.ChatMember)
+		err = tx.Where("chat_id = ?", chatID).
+			Order("CASE WHEN role = 'admin' THEN 0 ELSE 1 END").
+			Order("created_at ASC").
+			First(successor).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tx.Delete(&models.Chat{}, chatID).Error
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&models.ChatMember{}).
+			Where("chat_id = ? AND user_id = ?", chatID, successor.UserID).
+			Update("role", models.RoleOwner).Error
+	})
+}
+
+func (s *Storage) RenameGroup(chatID uint, actorID uint, name string) error {
+	name, err := groupName(name)
+	if err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		actor, err := s.groupMember(tx, chatID, actorID)
+		if err != nil {
+			return err
+		}
+		if !canManage(actor.Role) {
+			return ErrForbidden
+		}
+		return tx.Model(&models.Chat{}).Where("id = ?", chatID).Update("name", name).Error
+	})
+}
+
+// SetGroupMemberRole changes a member's role. Only the owner can do this, and
+// making someone else owner demotes the current owner to admin.
+func (s *Storage) SetGroupMemberRole(chatID uint, actorID uint, userID uint, role string) error {
+	if role != models.RoleOwner && role != models.RoleAdmin && role != models.RoleMember {
+		return errors.New("unknown role " + role)
+	}
+	if actorID == userID {
+		return errors.New("you cannot change your own role")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		actor, err := s.groupMember(tx, chatID, actorID)
+		if err != nil {
+			return err
+		}
+		if actor.Role != models.RoleOwner {
+			return ErrForbidden
+		}
+		if _, err := s.chatMember(tx, chatID, userID); err != nil {
+			return err
+		}
+		if role == models.RoleOwner {
+			if err := tx.Model(&models.ChatMember{}).
+				Where("chat_id = ? AND user_id = ?", chatID, actorID).
+				Update("role", models.RoleAdmin).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.ChatMember{}).
+			Where("chat_id = ? AND user_id = ?", chatID, userID).
+			Update("role", role).Error
+	})
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrIdentityEmailUnverified = errors.New("an account with this email already exists; sign in with your password and verify your email first")
+	ErrIdentityNoEmail         = errors.New("the provider did not share an email address")
+)
+
+//Linked Identities
+
+// SignInWithIdentity returns the user behind an outside login. Known
+// identities map straight to their user. New ones are linked to the account
+// with the same email only when both the provider and our own verification
+// vouch for that address, and get a fresh account when there is none.
+func (s *Storage) SignInWithIdentity(login *models.ExternalLogin) (*models.User, error) {
+	user := new(models.User)
+	now := time.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		identity := new(models.UserIdentity)
+		err := tx.Where("provider = ? AND subject = ?", login.Provider, login.Subject).First(identity).Error
+		if err == nil {
+			if err := tx.Model(identity).Updates(map[string]any{"email": login.Email, "last_login_at": now}).Error; err != nil {
+				return err
+			}
+			return tx.Where("id = ?", identity.UserID).First(user).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		email, err := NormalizeEmail(login.Email)
+		if err != nil {
+			return ErrIdentityNoEmail
+		}
+		err = tx.Where("email = ?", email).First(user).Error
+		switch {
+		case err == nil:
+			// Both sides must vouch for the address. Linking to an account
+			// that never proved it owns the email would let whoever
+			// registered it first keep their password and sessions.
+			if !login.EmailVerified || user.EmailVerifiedAt == nil {
+				return ErrIdentityEmailUnverified
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if err := createExternalUser(tx, user, login, email, now); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+		return tx.Create(&models.UserIdentity{
+			UserID:      user.ID,
+			Provider:    login.Provider,
+			Subject:     login.Subject,
+			Email:       email,
+			LastLoginAt: &now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// createExternalUser makes an account for someone who signed up through a
+// provider. It gets a random password nobody knows; a password reset sets a
+// real one.
+func createExternalUser(tx *gorm.DB, user *models.User, login *models.ExternalLogin, email string, now time.Time) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(base64.RawURLEncoding.EncodeToString(secret)), 10)
+	if err != nil {
+		return err
+	}
+	user.Name = strings.TrimSpace(login.Name)
+	if user.Name == "" {
+		user.Name, _, _ = strings.Cut(email, "@")
+	}
+	user.Email = email
+	user.Password = string(hash)
+	if login.EmailVerified {
+		user.EmailVerifiedAt = &now
+	}
+	if login.Picture != "" {
+		user.Pfp = login.Picture
+	}
+	return tx.Create(user).Error
+}
+
+func (s *Storage) GetIdentities(userID uint) ([]*models.UserIdentity, error) {
+	identities := make([]*models.UserIdentity, 0)
+	if err := s.db.Where("user_id = ?", userID).Order("created_at").Find(&identities).Error; err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+func (s *Storage) UnlinkIdentity(userID uint, id uint) error {
+	res := s.db.Where("id = ? AND user_id = ?", id, userID).Delete(&models.UserIdentity{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("identity not found")
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrEditWindowPassed = errors.New("message can no longer be changed")
+
+//Message Edits
+
+// ownMessage loads messageID for changes by userID, who must be its sender
+// and still be inside the edit window.
+func (s *Storage) ownMessage(tx *gorm.DB, userID uint, messageID uint) (*models.Message, error) {
+	msg := new(models.Message)
+	if err := tx.Where("id = ?", messageID).First(msg).Error; err != nil {
+		return nil, err
+	}
+	if msg.SenderID != userID {
+		return nil, ErrForbidden
+	}
+	if time.Since(msg.CreatedAt) > s.editWindow {
+		return nil, ErrEditWindowPassed
+	}
+	return msg, nil
+}
+
+// EditMessage replaces the content of a message, keeping the old content in
+// its edit history.
+func (s *Storage) EditMessage(userID uint, messageID uint, content string) (*models.Message, error) {
+	var msg *models.Message
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		msg, err = s.ownMessage(tx, userID, messageID)
+		if err != nil {
+			return err
+		}
+		if msg.Content == content {
+			return nil
+		}
+		if err := tx.Create(&models.MessageEdit{MessageID: msg.ID, Content: msg.Content}).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := tx.Model(msg).Updates(map[string]any{"content": content, "edited_at": now}).Error; err != nil {
+			return err
+		}
+		msg.Content = content
+		msg.EditedAt = &now
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *Storage) GetMessageEdits(userID uint, messageID uint) ([]*models.MessageEdit, error) {
+	msg := new(models.Message)
+	if err := s.db.Select("id", "chat_id").Where("id = ?", messageID).First(msg).Error; err != nil {
+		return nil, err
+	}
+	if !s.IsChatMember(msg.ChatID, userID) {
+		return nil, ErrNotChatMember
+	}
+	edits := make([]*models.MessageEdit, 0)
+	if err := s.db.Where("message_id = ?", messageID).Order("created_at ASC").Find(&edits).Error; err != nil {
+		return nil, err
+	}
+	return edits, nil
+}
+
+// DeleteMessageForEveryone wipes the content and history of a message and
+// soft deletes it so it no longer shows up for anyone.
+func (s *Storage) DeleteMessageForEveryone(userID uint, messageID uint) (*models.Message, error) {
+	var msg *models.Message
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		msg, err = s.ownMessage(tx, userID, messageID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("message_id = ?", msg.ID).Delete(&models.MessageEdit{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(msg).Update("content", "").Error; err != nil {
+			return err
+		}
+		return tx.Delete(msg).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// DeleteMessageForMe hides a message from userID's view of the chat only.
+func (s *Storage) DeleteMessageForMe(userID uint, messageID uint) (*models.Message, error) {
+	msg := new(models.Message)
+	if err := s.db.Select("id", "chat_id", "sender_id").Where("id = ?", messageID).First(msg).Error; err != nil {
+		return nil, err
+	}
+	if !s.IsChatMember(msg.ChatID, userID) {
+		return nil, ErrNotChatMember
+	}
+	if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.MessageHide{MessageID: msg.ID, UserID: userID}).Error; err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"fmt"
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -10,6 +13,14 @@ type User struct {
 	Email            string           `gorm:"uniqueIndex;not null" json:"email"`
 	Pfp              string           `gorm:"default:'https://images.unsplash.com/photo-1618979251882-0b40ef3617f0?q=80&w=687&auto=format&fit=crop&ixlib=rb-4.1.0&ixid=M3wxMjA3fDB8MHxwaG90by1wYWdlfHx8fGVufDB8fHx8fA%3D%3D'" json:"pfp"`
 	Password         string           `gorm:"not null" json:"-"`
+	EmailVerifiedAt  *time.Time       `json:"email_verified_at"`
+	TOTPSecret       string           `gorm:"column:totp_secret" json:"-"`
+	TOTPEnabledAt    *time.Time       `gorm:"column:totp_enabled_at" json:"totp_enabled_at"`
+	TOTPLastStep     int64            `gorm:"column:totp_last_step" json:"-"`
+	Identities       []*UserIdentity  `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"identities,omitempty"`
+	Username         *string          `gorm:"uniqueIndex;size:32" json:"username"`
+	Discoverability  string           `gorm:"type:varchar(24);not null;default:'everyone'" json:"discoverability"`
+	LastSeen         *time.Time       `json:"last_seen,omitempty"`
 	Friends          []*User          `gorm:"many2many:user_friends;joinForeignKey:UserID;joinReferences:FriendID" json:"friends"`
 	Chats            []*Chat          `gorm:"many2many:user_chats" json:"chats"`
 	SentRequests     []*FriendRequest `gorm:"foreignKey:FromID;constraint:OnDelete:CASCADE" json:"sent_requests,omitempty"`
@@ -18,38 +29,382 @@ type User struct {
 	ReceivedMessages []*Message       `gorm:"foreignKey:ReceiverID;constraint:OnDelete:CASCADE"`
 }
 
+const (
+	DiscoverEveryone         = "everyone"
+	DiscoverFriendsOfFriends = "friends_of_friends"
+	DiscoverNobody           = "nobody"
+)
+
+// PublicProfile is what other users get to see about someone.
+type PublicProfile struct {
+	ID       uint    `json:"id"`
+	Name     string  `json:"name"`
+	Username *string `json:"username"`
+	Pfp      string  `json:"pfp"`
+}
+
+// Profile returns the public part of u, or nil when u is nil.
+func (u *User) Profile() *PublicProfile {
+	if u == nil {
+		return nil
+	}
+	return &PublicProfile{ID: u.ID, Name: u.Name, Username: u.Username, Pfp: u.Pfp}
+}
+
 type Chat struct {
 	gorm.Model
-	Name     string     `gorm:"not null" json:"name"`
-	IsGroup  bool       `gorm:"default:false" json:"is_group"`
-	Users    []*User    `gorm:"many2many:user_chats" json:"users"`
-	Messages []*Message `gorm:"foreignKey:ChatID;constraint:OnDelete:CASCADE" json:"messages"`
+	Name     string        `gorm:"not null" json:"name"`
+	IsGroup  bool          `gorm:"default:false" json:"is_group"`
+	Users    []*User       `gorm:"many2many:user_chats" json:"users"`
+	Members  []*ChatMember `gorm:"foreignKey:ChatID" json:"members,omitempty"`
+	Messages []*Message    `gorm:"foreignKey:ChatID;constraint:OnDelete:CASCADE" json:"messages"`
+}
+
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// ChatMember is the user_chats join row between User.Chats and Chat.Users,
+// carrying the member's role in the chat.
+type ChatMember struct {
+	UserID            uint       `gorm:"primaryKey" json:"user_id"`
+	User              *User      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"user,omitempty"`
+	ChatID            uint       `gorm:"primaryKey" json:"chat_id"`
+	Chat              *Chat      `gorm:"foreignKey:ChatID;constraint:OnDelete:CASCADE" json:"-"`
+	Role              string     `gorm:"type:varchar(16);not null;default:'member'" json:"role"`
+	LastReadMessageID uint       `gorm:"not null;default:0" json:"last_read_message_id"`
+	Muted             bool       `gorm:"not null;default:false" json:"muted"`
+	MutedUntil        *time.Time `json:"muted_until,omitempty"`
+	HiddenAt          *time.Time `json:"-"`
+	CreatedAt         time.Time  `json:"joined_at"`
+}
+
+// IsMuted reports whether the member has muted the chat right now.
+func (m *ChatMember) IsMuted(now time.Time) bool {
+	return m.Muted && (m.MutedUntil == nil || now.Before(*m.MutedUntil))
+}
+
+// Block stops BlockedID from reaching BlockerID in any way.
+type Block struct {
+	BlockerID uint      `gorm:"primaryKey" json:"blocker_id"`
+	Blocker   *User     `gorm:"foreignKey:BlockerID;constraint:OnDelete:CASCADE" json:"-"`
+	BlockedID uint      `gorm:"primaryKey;index" json:"blocked_id"`
+	Blocked   *User     `gorm:"foreignKey:BlockedID;constraint:OnDelete:CASCADE" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (ChatMember) TableName() string {
+	return "user_chats"
+}
+
+// Presence records that a hub node holds at least one connection for a
+// user. Nodes refresh SeenAt on a heartbeat, so rows left by a node that
+// died stop counting once they go stale.
+type Presence struct {
+	NodeID string    `gorm:"primaryKey;size:32"`
+	UserID uint      `gorm:"primaryKey;index"`
+	User   *User     `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	SeenAt time.Time `gorm:"not null;index"`
 }
 
 type Message struct {
 	gorm.Model
-	Content    string `gorm:"type:text;not null" json:"content"`
+	Content       string            `gorm:"type:text;not null" json:"content"`
+	ChatID        uint              `gorm:"index;not null" json:"chat_id"`
+	Chat          *Chat             `gorm:"constraint:OnDelete:CASCADE;" json:"-"`
+	SenderID      uint              `gorm:"index;not null" json:"sender_id"`
+	Sender        *User             `gorm:"foreignKey:SenderID;constraint:OnDelete:CASCADE;" json:"sender,omitempty"`
+	ReceiverID    *uint             `gorm:"index" json:"receiver_id,omitempty"` // nil for group chats
+	Receiver      *User             `gorm:"foreignKey:ReceiverID;constraint:OnDelete:CASCADE;" json:"receiver,omitempty"`
+	EditedAt      *time.Time        `json:"edited_at,omitempty"`
+	ReplyToID     *uint             `gorm:"index" json:"reply_to_id,omitempty"`
+	ReplyTo       *Message          `gorm:"foreignKey:ReplyToID;constraint:OnDelete:SET NULL" json:"reply_to,omitempty"`
+	Receipts      []*MessageReceipt `gorm:"foreignKey:MessageID;constraint:OnDelete:CASCADE" json:"receipts,omitempty"`
+	Reactions     []*ReactionCount  `gorm:"-" json:"reactions,omitempty"`
+	Attachments   []*Attachment     `gorm:"foreignKey:MessageID;constraint:OnDelete:CASCADE" json:"attachments,omitempty"`
+	AttachmentIDs []uint            `gorm:"-" json:"-"`
+}
+
+// Attachment is a file uploaded into a chat. It has no MessageID until the
+// message referencing it is sent.
+type Attachment struct {
+	gorm.Model
+	MessageID  *uint  `gorm:"index" json:"message_id,omitempty"`
 	ChatID     uint   `gorm:"index;not null" json:"chat_id"`
-	Chat       *Chat  `gorm:"constraint:OnDelete:CASCADE;" json:"-"`
-	SenderID   uint   `gorm:"index;not null" json:"sender_id"`
-	Sender     *User  `gorm:"foreignKey:SenderID;constraint:OnDelete:CASCADE;" json:"sender,omitempty"`
-	ReceiverID uint   `gorm:"index;not null" json:"receiver_id"`
-	Receiver   *User  `gorm:"foreignKey:ReceiverID;constraint:OnDelete:CASCADE;" json:"receiver,omitempty"`
+	Chat       *Chat  `gorm:"foreignKey:ChatID;constraint:OnDelete:CASCADE" json:"-"`
+	UploaderID uint   `gorm:"index;not null" json:"uploader_id"`
+	Uploader   *User  `gorm:"foreignKey:UploaderID;constraint:OnDelete:CASCADE" json:"-"`
+	FileName   string `gorm:"not null" json:"file_name"`
+	MIMEType   string `gorm:"not null" json:"mime_type"`
+	Size       int64  `gorm:"not null" json:"size"`
+	StorageKey string `gorm:"not null" json:"-"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	URL        string `gorm:"-" json:"url"`
+}
+
+func (a *Attachment) AfterFind(tx *gorm.DB) error {
+	a.URL = fmt.Sprintf("/api/attachments/%d", a.ID)
+	return nil
 }
 
+func (a *Attachment) AfterCreate(tx *gorm.DB) error {
+	return a.AfterFind(tx)
+}
+
+type Reaction struct {
+	MessageID uint      `gorm:"primaryKey" json:"message_id"`
+	Message   *Message  `gorm:"foreignKey:MessageID;constraint:OnDelete:CASCADE" json:"-"`
+	UserID    uint      `gorm:"primaryKey" json:"user_id"`
+	User      *User     `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+	Emoji     string    `gorm:"primaryKey;type:varchar(32)" json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReactionCount is how many members reacted to a message with one emoji.
+type ReactionCount struct {
+	MessageID uint   `json:"-"`
+	Emoji     string `json:"emoji"`
+	Count     int64  `json:"count"`
+	Me        bool   `json:"me"`
+}
+
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+// MessageEdit keeps the content a message had before one of its edits.
+type MessageEdit struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	MessageID uint      `gorm:"index;not null" json:"message_id"`
+	Message   *Message  `gorm:"foreignKey:MessageID;constraint:OnDelete:CASCADE" json:"-"`
+	Content   string    `gorm:"type:text;not null" json:"content"`
+	CreatedAt time.Time `json:"edited_at"`
+}
+
+// MessageHide is a message one user deleted for themselves only.
+type MessageHide struct {
+	MessageID uint      `gorm:"primaryKey" json:"message_id"`
+	Message   *Message  `gorm:"foreignKey:MessageID;constraint:OnDelete:CASCADE" json:"-"`
+	UserID    uint      `gorm:"primaryKey" json:"user_id"`
+	User      *User     `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	DeliverySent      = "sent"
+	DeliveryDelivered = "delivered"
+	DeliveryRead      = "read"
+)
+
+// MessageReceipt tracks how far a message got for one recipient.
+type MessageReceipt struct {
+	MessageID   uint       `gorm:"primaryKey" json:"message_id"`
+	UserID      uint       `gorm:"primaryKey;index:idx_receipts_user_status,priority:1" json:"user_id"`
+	User        *User      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+	Status      string     `gorm:"type:varchar(16);not null;default:'sent';index:idx_receipts_user_status,priority:2" json:"status"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	ReadAt      *time.Time `json:"read_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+const (
+	RequestPending   = "pending"
+	RequestAccepted  = "accepted"
+	RequestRejected  = "rejected"
+	RequestCancelled = "cancelled"
+)
+
 type FriendRequest struct {
 	gorm.Model
-	FromID uint   `gorm:"index;not null" json:"from_id"`
-	From   *User  `gorm:"foreignKey:FromID;constraint:OnDelete:CASCADE" json:"from,omitempty"`
-	ToID   uint   `gorm:"index;not null" json:"to_id"`
-	To     *User  `gorm:"foreignKey:ToID;constraint:OnDelete:CASCADE" json:"to,omitempty"`
-	Status string `gorm:"type:enum('pending','accepted','rejected');default:'pending'" json:"status"`
+	FromID      uint           `gorm:"index;not null" json:"from_id"`
+	From        *User          `gorm:"foreignKey:FromID;constraint:OnDelete:CASCADE" json:"-"`
+	ToID        uint           `gorm:"index;not null" json:"to_id"`
+	To          *User          `gorm:"foreignKey:ToID;constraint:OnDelete:CASCADE" json:"-"`
+	Status      string         `gorm:"type:varchar(16);not null;default:'pending';index" json:"status"`
+	RespondedAt *time.Time     `json:"responded_at,omitempty"`
+	FromProfile *PublicProfile `gorm:"-" json:"from,omitempty"`
+	ToProfile   *PublicProfile `gorm:"-" json:"to,omitempty"`
+}
+
+// AfterFind exposes only the public profiles of preloaded users, never
+// their full rows.
+func (r *FriendRequest) AfterFind(tx *gorm.DB) error {
+	r.FromProfile, r.ToProfile = r.From.Profile(), r.To.Profile()
+	return nil
+}
+
+const (
+	NotifyFriendRequest   = "friend_request.received"
+	NotifyRequestAccepted = "friend_request.accepted"
+	NotifyRequestDeclined = "friend_request.declined"
+	NotifyRequestCanceled = "friend_request.cancelled"
+)
+
+// Notification is an entry in a user's inbox.
+type Notification struct {
+	ID        uint       `gorm:"primarykey" json:"id"`
+	UserID    uint       `gorm:"not null;index:idx_notifications_user_created,priority:1" json:"user_id"`
+	User      *User      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+	Type      string     `gorm:"type:varchar(48);not null" json:"type"`
+	ActorID   *uint      `json:"actor_id,omitempty"`
+	Actor     *User      `gorm:"foreignKey:ActorID;constraint:OnDelete:CASCADE" json:"-"`
+	RequestID *uint      `json:"request_id,omitempty"`
+	ChatID    *uint      `json:"chat_id,omitempty"`
+	MessageID *uint      `json:"message_id,omitempty"`
+	ReadAt    *time.Time `gorm:"index" json:"read_at"`
+	CreatedAt time.Time  `gorm:"index:idx_notifications_user_created,priority:2" json:"created_at"`
+	// ActorProfile is what clients see of Actor.
+	ActorProfile *PublicProfile `gorm:"-" json:"actor,omitempty"`
+}
+
+func (n *Notification) AfterFind(tx *gorm.DB) error {
+	n.ActorProfile = n.Actor.Profile()
+	return nil
+}
+
+// NotificationSettings controls how a user is reached outside the app. The
+// in-app inbox is always on.
+type NotificationSettings struct {
+	UserID     uint   `gorm:"primaryKey" json:"-"`
+	User       *User  `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+	Email      bool   `gorm:"not null;default:true" json:"email"`
+	Webhook    bool   `gorm:"not null;default:false" json:"webhook"`
+	WebhookURL string `gorm:"size:2048" json:"webhook_url"`
+	// WebhookSecret signs webhook bodies. It is generated whenever the URL
+	// changes and only shown in that response.
+	WebhookSecret  string    `gorm:"size:64" json:"-"`
+	Messages       bool      `gorm:"not null;default:true" json:"messages"`
+	FriendRequests bool      `gorm:"not null;default:true" json:"friend_requests"`
+	QuietStart     string    `gorm:"size:5" json:"quiet_start"`
+	QuietEnd       string    `gorm:"size:5" json:"quiet_end"`
+	TimeZone       string    `gorm:"size:64;not null;default:'UTC'" json:"time_zone"`
+	DigestMinutes  int       `gorm:"not null;default:15" json:"digest_minutes"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenResetPassword = "reset_password"
+	TokenChangeEmail   = "change_email"
+	TokenLoginTwoStep  = "login_2fa"
+)
+
+// UserToken backs a single use token we hand out, such as an emailed link or
+// a login challenge. Only a hash of its random part is stored.
+type UserToken struct {
+	ID        uint      `gorm:"primarykey"`
+	UserID    uint      `gorm:"not null;index"`
+	User      *User     `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	Purpose   string    `gorm:"type:varchar(24);not null;index"`
+	NonceHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	// NewEmail is the address a change_email token switches to.
+	NewEmail string
+	// Attempts counts wrong codes entered against a login_2fa token.
+	Attempts  int
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// UserIdentity links an account to a login at an outside identity provider.
+type UserIdentity struct {
+	ID          uint       `gorm:"primarykey" json:"id"`
+	UserID      uint       `gorm:"not null;index" json:"-"`
+	User        *User      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+	Provider    string     `gorm:"type:varchar(32);not null;uniqueIndex:idx_identity_provider_subject,priority:1" json:"provider"`
+	Subject     string     `gorm:"not null;uniqueIndex:idx_identity_provider_subject,priority:2" json:"-"`
+	Email       string     `json:"email"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+// RecoveryCode is a one time code that stands in for a TOTP code when the
+// authenticator is lost.
+type RecoveryCode struct {
+	ID        uint   `gorm:"primarykey"`
+	UserID    uint   `gorm:"not null;index"`
+	User      *User  `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	CodeHash  string `gorm:"not null;uniqueIndex"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// RefreshToken is one link in a rotation chain. Every token issued from the
+// same login shares a FamilyID so that the whole chain can be revoked at once.
+type RefreshToken struct {
+	gorm.Model
+	UserID    uint       `gorm:"index;not null" json:"user_id"`
+	User      *User      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+	FamilyID  string     `gorm:"index;not null" json:"family_id"`
+	TokenHash string     `gorm:"uniqueIndex;not null" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	RevokedAt *time.Time `gorm:"index" json:"revoked_at"`
+}
+
+// ChatSummary is a chat as shown in a user's chat list.
+type ChatSummary struct {
+	*Chat
+	LastReadMessageID uint       `json:"last_read_message_id"`
+	UnreadCount       int64      `json:"unread_count"`
+	LastMessage       *Message   `json:"last_message"`
+	Muted             bool       `json:"muted"`
+	MutedUntil        *time.Time `json:"muted_until,omitempty"`
+}
+
+type MessageSearch struct {
+	Query    string
+	ChatID   uint
+	SenderID uint
+	From     *time.Time
+	To       *time.Time
+	Limit    int
+	Offset   int
+}
+
+// MessageSearchHit is one search result. Highlight is HTML escaped content
+// with the matching terms wrapped in <mark> tags.
+type MessageSearchHit struct {
+	MessageID uint      `json:"message_id"`
+	ChatID    uint      `json:"chat_id"`
+	SenderID  uint      `json:"sender_id"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+	Rank      float64   `json:"rank"`
+	Highlight string    `json:"highlight"`
+}
+
+type MessageQuery struct {
+	ChatID uint
+	Before uint
+	After  uint
+	Limit  int
+}
+
+type CreateGroup struct {
+	Name      string `json:"name"`
+	MemberIDs []uint `json:"member_ids"`
+}
+
+// ProfileUpdate is a partial edit of the caller's own profile. Nil fields
+// are left alone.
+type ProfileUpdate struct {
+	Name *string `json:"name"`
+	Pfp  *string `json:"-"`
 }
 
-type UpdateUser struct {
-	Email string `json:"email"`
-	Field string `json:"field"`
-	Value string `json:"value"`
+// ExternalLogin is a successful sign in at an identity provider.
+type ExternalLogin struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
 }
 
 type LoginUser struct {
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxNotificationPage = 100
+
+var ErrNotificationNotFound = errors.New("notification not found")
+
+//Notifications
+
+func (s *Storage) CreateNotification(n *models.Notification) error {
+	if err := s.db.Create(n).Error; err != nil {
+		return err
+	}
+	if n.ActorID != nil {
+		actor := new(models.User)
+		if err := s.db.Where("id = ?", *n.ActorID).First(actor).Error; err == nil {
+			n.Actor, n.ActorProfile = actor, actor.Profile()
+		}
+	}
+	return nil
+}
+
+// GetNotifications returns the user's notifications newest first, starting
+// below the before cursor when it is set.
+func (s *Storage) GetNotifications(userID uint, unreadOnly bool, before uint, limit int) ([]*models.Notification, error) {
+	if limit <= 0 || limit > maxNotificationPage {
+		limit = maxNotificationPage
+	}
+	q := s.db.Preload("Actor").Where("user_id = ?", userID)
+	if unreadOnly {
+		q = q.Where("read_at IS NULL")
+	}
+	if before > 0 {
+		q = q.Where("id < ?", before)
+	}
+	notifications := make([]*models.Notification, 0)
+	if err := q.Order("id DESC").Limit(limit).Find(&notifications).Error; err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+func (s *Storage) UnreadNotificationCount(userID uint) (int64, error) {
+	var count int64
+	err := s.db.Model(&models.Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+func (s *Storage) MarkNotificationRead(userID uint, id uint) error {
+	res := s.db.Model(&models.Notification{}).
+		Where("id = ? AND user_id = ?", id, userID).
+		Update("read_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotificationNotFound
+	}
+	return nil
+}
+
+// MarkAllNotificationsRead marks every unread notification of the user read
+// and returns how many there were.
+func (s *Storage) MarkAllNotificationsRead(userID uint) (int64, error) {
+	res := s.db.Model(&models.Notification{}).
+		Where("user_id = ? AND read_at IS NULL", userID).
+		Update("read_at", time.Now())
+	return res.RowsAffected, res.Error
+}
+
+// GetNotificationSettings returns the user's settings, or the defaults when
+// they never changed them.
+func (s *Storage) GetNotificationSettings(userID uint) (*models.NotificationSettings, error) {
+	settings := new(models.NotificationSettings)
+	err := s.db.Where("user_id = ?", userID).First(settings).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &models.NotificationSettings{
+			UserID:         userID,
+			Email:          true,
+			Messages:       true,
+			FriendRequests: true,
+			TimeZone:       "UTC",
+			DigestMinutes:  15,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (s *Storage) SaveNotificationSettings(settings *models.NotificationSettings) error {
+	// Select("*") so that switched off flags are written instead of falling
+	// back to their column defaults.
+	return s.db.Select("*").Clauses(clause.OnConflict{UpdateAll: true}).Create(settings).Error
+}
+
+// UnreadMessageIDs returns the messages in ids that userID has not read yet.
+func (s *Storage) UnreadMessageIDs(userID uint, ids []uint) ([]uint, error) {
+	unread := make([]uint, 0)
+	if len(ids) == 0 {
+		return unread, nil
+	}
+	if err := s.db.Model(&models.MessageReceipt{}).
+		Where("user_id = ? AND message_id IN ? AND status <> ?", userID, ids, models.DeliveryRead).
+		Pluck("message_id", &unread).Error; err != nil {
+		return nil, err
+	}
+	return unread, nil
+}
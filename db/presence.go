@@ -0,0 +1,93 @@
+package db
+
+import (
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PresenceTTL is how long a node's presence rows count without a heartbeat.
+const PresenceTTL = 90 * time.Second
+
+//Presence
+
+// livePresence counts the rows for userID that a node refreshed recently.
+func livePresence(tx *gorm.DB, userID uint) (int64, error) {
+	var count int64
+	err := tx.Model(&models.Presence{}).
+		Where("user_id = ? AND seen_at > ?", userID, time.Now().Add(-PresenceTTL)).
+		Count(&count).Error
+	return count, err
+}
+
+// AddPresence records that nodeID holds a connection for userID. It reports
+// whether no other node did, i.e. whether the user just came online.
+func (s *Storage) AddPresence(nodeID string, userID uint) (bool, error) {
+	if err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "node_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"seen_at"}),
+	}).Create(&models.Presence{NodeID: nodeID, UserID: userID, SeenAt: time.Now()}).Error; err != nil {
+		return false, err
+	}
+	count, err := livePresence(s.db, userID)
+	return count <= 1, err
+}
+
+// RemovePresence records that nodeID dropped its last connection for
+// userID. It reports whether no node holds one any more, i.e. whether the
+// user just went offline.
+func (s *Storage) RemovePresence(nodeID string, userID uint) (bool, error) {
+	if err := s.db.Where("node_id = ? AND user_id = ?", nodeID, userID).Delete(&models.Presence{}).Error; err != nil {
+		return false, err
+	}
+	count, err := livePresence(s.db, userID)
+	return count == 0, err
+}
+
+// SyncPresence is a node's heartbeat: its rows become exactly userIDs, all
+// freshly seen, and rows that every node let go stale are removed.
+func (s *Storage) SyncPresence(nodeID string, userIDs []uint) error {
+	now := time.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		drop := tx.Where("node_id = ?", nodeID)
+		if len(userIDs) > 0 {
+			drop = drop.Where("user_id NOT IN ?", userIDs)
+		}
+		if err := drop.Delete(&models.Presence{}).Error; err != nil {
+			return err
+		}
+		if len(userIDs) > 0 {
+			rows := make([]*models.Presence, len(userIDs))
+			for i, id := range userIDs {
+				rows[i] = &models.Presence{NodeID: nodeID, UserID: id, SeenAt: now}
+			}
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "node_id"}, {Name: "user_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"seen_at"}),
+			}).CreateInBatches(rows, 500).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Where("seen_at <= ?", now.Add(-PresenceTTL)).Delete(&models.Presence{}).Error
+	})
+}
+
+// OnlineAmong returns which of userIDs are connected to any live node.
+func (s *Storage) OnlineAmong(userIDs []uint) (map[uint]bool, error) {
+	online := make(map[uint]bool)
+	if len(userIDs) == 0 {
+		return online, nil
+	}
+	ids := make([]uint, 0, len(userIDs))
+	if err := s.db.Model(&models.Presence{}).
+		Where("user_id IN ? AND seen_at > ?", userIDs, time.Now().Add(-PresenceTTL)).
+		Distinct().Pluck("user_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		online[id] = true
+	}
+	return online, nil
+}
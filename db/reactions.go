@@ -0,0 +1,94 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"gorm.io/gorm/clause"
+)
+
+const maxEmojiRunes = 8
+
+//Reactions
+
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > 32 || !utf8.ValidString(emoji) {
+		return false
+	}
+	if utf8.RuneCountInString(emoji) > maxEmojiRunes {
+		return false
+	}
+	return !strings.ContainsFunc(emoji, unicode.IsSpace)
+}
+
+// reactableMessage loads a message userID can react to.
+func (s *Storage) reactableMessage(userID uint, messageID uint) (*models.Message, error) {
+	msg := new(models.Message)
+	if err := s.db.Select("id", "chat_id").Where("id = ?", messageID).First(msg).Error; err != nil {
+		return nil, err
+	}
+	if !s.IsChatMember(msg.ChatID, userID) {
+		return nil, ErrNotChatMember
+	}
+	return msg, nil
+}
+
+func (s *Storage) AddReaction(userID uint, messageID uint, emoji string) (*models.Message, error) {
+	if !validEmoji(emoji) {
+		return nil, errors.New("invalid emoji")
+	}
+	msg, err := s.reactableMessage(userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Reaction{
+		MessageID: msg.ID,
+		UserID:    userID,
+		Emoji:     emoji,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *Storage) RemoveReaction(userID uint, messageID uint, emoji string) (*models.Message, error) {
+	msg, err := s.reactableMessage(userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Where("message_id = ? AND user_id = ? AND emoji = ?", msg.ID, userID, emoji).Delete(&models.Reaction{}).Error; err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// attachReactions fills in the aggregated reactions of messages as seen by userID.
+func (s *Storage) attachReactions(userID uint, messages []*models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]uint, 0, len(messages))
+	byID := make(map[uint]*models.Message, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+		byID[m.ID] = m
+	}
+	counts := make([]*models.ReactionCount, 0)
+	if err := s.db.Model(&models.Reaction{}).
+		Select("message_id, emoji, COUNT(*) AS count, BOOL_OR(user_id = ?) AS me", userID).
+		Where("message_id IN ?", ids).
+		Group("message_id, emoji").
+		Order("MIN(created_at) ASC").
+		Scan(&counts).Error; err != nil {
+		return err
+	}
+	for _, c := range counts {
+		if m, ok := byID[c.MessageID]; ok {
+			m.Reactions = append(m.Reactions, c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"gorm.io/gorm"
+)
+
+const maxPendingDeliveries = 500
+
+//Delivery Receipts
+
+// UndeliveredMessages returns the oldest messages userID has not yet
+// acknowledged, in the order they were sent.
+func (s *Storage) UndeliveredMessages(userID uint) ([]*models.Message, error) {
+	messages := make([]*models.Message, 0)
+	if err := s.db.Model(&models.Message{}).
+		Joins("JOIN message_receipts mr ON mr.message_id = messages.id").
+		Where("mr.user_id = ? AND mr.status = ?", userID, models.DeliverySent).
+		Preload("ReplyTo").
+		Preload("Attachments").
+		Order("messages.created_at ASC, messages.id ASC").
+		Limit(maxPendingDeliveries).
+		Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// MarkMessagesDelivered moves userID's receipts for messageIDs from "sent" to
+// "delivered" and returns the messages whose state actually changed.
+func (s *Storage) MarkMessagesDelivered(userID uint, messageIDs []uint) ([]*models.Message, error) {
+	changed := make([]*models.Message, 0)
+	if len(messageIDs) == 0 {
+		return changed, nil
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Message{}).
+			Select("messages.id", "messages.chat_id", "messages.sender_id").
+			Joins("JOIN message_receipts mr ON mr.message_id = messages.id").
+			Where("mr.user_id = ? AND mr.status = ? AND mr.message_id IN ?", userID, models.DeliverySent, messageIDs).
+			Find(&changed).Error; err != nil {
+			return err
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		ids := make([]uint, 0, len(changed))
+		for _, m := range changed {
+			ids = append(ids, m.ID)
+		}
+		return tx.Model(&models.MessageReceipt{}).
+			Where("user_id = ? AND message_id IN ? AND status = ?", userID, ids, models.DeliverySent).
+			Updates(map[string]any{"status": models.DeliveryDelivered, "delivered_at": time.Now()}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
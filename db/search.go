@@ -0,0 +1,80 @@
+package db
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+)
+
+// searchConfig is the text search configuration for message content. The
+// "simple" one does no stemming, which keeps results sane across languages.
+const searchConfig = "simple"
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 50
+)
+
+//Search
+
+// migrateMessageSearch adds the generated tsvector column and GIN index that
+// SearchMessages relies on. Both are outside the Message model so that
+// AutoMigrate leaves them alone.
+func (s *Storage) migrateMessageSearch() error {
+	if err := s.db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (to_tsvector('` + searchConfig + `', coalesce(content, ''))) STORED`).Error; err != nil {
+		return err
+	}
+	return s.db.Exec("CREATE INDEX IF NOT EXISTS idx_messages_search_vector ON messages USING GIN (search_vector)").Error
+}
+
+// SearchMessages runs a web style search (quoted phrases, OR, -exclusions)
+// over the messages in chats userID belongs to, best matches first.
+func (s *Storage) SearchMessages(userID uint, q *models.MessageSearch) ([]*models.MessageSearchHit, error) {
+	text := strings.TrimSpace(q.Query)
+	if text == "" {
+		return nil, errors.New("search query is required")
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultSearchPageSize
+	}
+	if limit > maxSearchPageSize {
+		limit = maxSearchPageSize
+	}
+	offset := max(q.Offset, 0)
+
+	query := s.db.Table("messages m").
+		Select(`m.id AS message_id, m.chat_id, m.sender_id, m.content, m.created_at,
+			ts_rank(m.search_vector, q) AS rank,
+			ts_headline('`+searchConfig+`',
+				replace(replace(replace(m.content, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'),
+				q, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5') AS highlight`).
+		Joins("JOIN user_chats uc ON uc.chat_id = m.chat_id AND uc.user_id = ?", userID).
+		Joins("CROSS JOIN websearch_to_tsquery('"+searchConfig+"', ?) AS q", text).
+		Where("m.deleted_at IS NULL AND m.search_vector @@ q").
+		Where("NOT EXISTS (SELECT 1 FROM message_hides mh WHERE mh.message_id = m.id AND mh.user_id = ?)", userID)
+	if q.ChatID != 0 {
+		query = query.Where("m.chat_id = ?", q.ChatID)
+	}
+	if q.SenderID != 0 {
+		query = query.Where("m.sender_id = ?", q.SenderID)
+	}
+	if q.From != nil {
+		query = query.Where("m.created_at >= ?", *q.From)
+	}
+	if q.To != nil {
+		query = query.Where("m.created_at < ?", *q.To)
+	}
+
+	hits := make([]*models.MessageSearchHit, 0)
+	if err := query.
+		Order("rank DESC, m.created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Scan(&hits).Error; err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+//Refresh Tokens
+
+func (s *Storage) CreateRefreshToken(userID uint, family string, hash string, expiresAt time.Time) error {
+	return s.db.Create(&models.RefreshToken{
+		UserID:    userID,
+		FamilyID:  family,
+		TokenHash: hash,
+		ExpiresAt: expiresAt,
+	}).Error
+}
+
+// RotateRefreshToken marks the token matching hash as used and issues its
+// successor in the same family. Presenting a token that was already used
+// revokes the whole family, since one of the two holders must be an attacker.
+func (s *Storage) RotateRefreshToken(hash string, newHash string, expiresAt time.Time) (*models.RefreshToken, error) {
+	next := new(models.RefreshToken)
+	reused := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		current := new(models.RefreshToken)
+		if err := tx.Where("token_hash = ?", hash).First(current).Error; err != nil {
+			return ErrRefreshTokenInvalid
+		}
+		if current.RevokedAt != nil || time.Now().After(current.ExpiresAt) {
+			return ErrRefreshTokenInvalid
+		}
+		if current.UsedAt != nil {
+			reused = true
+			return ErrRefreshTokenReused
+		}
+		now := time.Now()
+		res := tx.Model(&models.RefreshToken{}).Where("id = ? AND used_at IS NULL", current.ID).Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			// Lost a race against another request presenting the same token.
+			reused = true
+			return ErrRefreshTokenReused
+		}
+		next.UserID = current.UserID
+		next.FamilyID = current.FamilyID
+		next.TokenHash = newHash
+		next.ExpiresAt = expiresAt
+		return tx.Create(next).Error
+	})
+	if reused {
+		if family, ferr := s.refreshTokenFamily(hash); ferr == nil {
+			s.RevokeTokenFamily(family)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+func (s *Storage) refreshTokenFamily(hash string) (string, error) {
+	token := new(models.RefreshToken)
+	if err := s.db.Unscoped().Where("token_hash = ?", hash).First(token).Error; err != nil {
+		return "", err
+	}
+	return token.FamilyID, nil
+}
+
+// RevokeRefreshToken revokes the family that the token matching hash belongs to.
+func (s *Storage) RevokeRefreshToken(hash string) error {
+	family, err := s.refreshTokenFamily(hash)
+	if err != nil {
+		return err
+	}
+	return s.RevokeTokenFamily(family)
+}
+
+func (s *Storage) RevokeTokenFamily(family string) error {
+	return s.db.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", family).
+		Update("revoked_at", time.Now()).Error
+}
+
+// IsTokenFamilyActive reports whether a login session can still be used,
+// i.e. it has at least one unrevoked and unexpired refresh token.
+func (s *Storage) IsTokenFamilyActive(family string) bool {
+	var count int64
+	if err := s.db.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL AND expires_at > ?", family, time.Now()).
+		Count(&count).Error; err != nil {
+		return false
+	}
+	return count > 0
+}
+
+// RevokeUserSessions signs the user out on every device.
+func (s *Storage) RevokeUserSessions(userID uint) error {
+	return revokeUserSessions(s.db, userID)
+}
+
+func revokeUserSessions(tx *gorm.DB, userID uint) error {
+	return tx.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// revokeOtherSessions signs the user out everywhere except the session
+// family keepFamily, which is normally the caller's own.
+func revokeOtherSessions(tx *gorm.DB, userID uint, keepFamily string) error {
+	return tx.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND family_id <> ? AND revoked_at IS NULL", userID, keepFamily).
+		Update("revoked_at", time.Now()).Error
+}
+
+//Mail Tokens
+
+var ErrUserTokenInvalid = errors.New("link is invalid or has expired")
+
+// CreateUserToken stores token. Any earlier unused token of the same user and
+// purpose stops working.
+func (s *Storage) CreateUserToken(token *models.UserToken) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.UserToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", token.UserID, token.Purpose).
+			Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Create(token).Error
+	})
+}
+
+// UserTokenIssuedSince reports whether a token for purpose was sent to the
+// user after since. It keeps people from flooding an inbox with links.
+func (s *Storage) UserTokenIssuedSince(userID uint, purpose string, since time.Time) bool {
+	var count int64
+	if err := s.db.Model(&models.UserToken{}).
+		Where("user_id = ? AND purpose = ? AND created_at > ?", userID, purpose, since).
+		Count(&count).Error; err != nil {
+		return false
+	}
+	return count > 0
+}
+
+// consumeUserToken marks a token used. It fails unless the token exists,
+// matches purpose and nonceHash, and is unused and unexpired.
+func consumeUserToken(tx *gorm.DB, id uint, purpose string, nonceHash string) (*models.UserToken, error) {
+	token := new(models.UserToken)
+	if err := tx.Where("id = ? AND purpose = ? AND nonce_hash = ?", id, purpose, nonceHash).First(token).Error; err != nil {
+		return nil, ErrUserTokenInvalid
+	}
+	if token.UsedAt != nil || time.Now().After(token.ExpiresAt) {
+		return nil, ErrUserTokenInvalid
+	}
+	res := tx.Model(&models.UserToken{}).Where("id = ? AND used_at IS NULL", token.ID).Update("used_at", time.Now())
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrUserTokenInvalid
+	}
+	return token, nil
+}
+
+// VerifyEmail confirms the address of the user the token was issued to.
+func (s *Storage) VerifyEmail(id uint, nonceHash string) (*models.User, error) {
+	user := new(models.User)
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		token, err := consumeUserToken(tx, id, models.TokenVerifyEmail, nonceHash)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&models.User{}).
+			Where("id = ? AND email_verified_at IS NULL", token.UserID).
+			Update("email_verified_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", token.UserID).First(user).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ResetPassword sets a new password for the user the token was issued to and
+// ends all of their sessions. Following the emailed link also proves they own
+// the address, so it is marked verified.
+func (s *Storage) ResetPassword(id uint, nonceHash string, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		token, err := consumeUserToken(tx, id, models.TokenResetPassword, nonceHash)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&models.User{}).Where("id = ?", token.UserID).Updates(map[string]any{
+			"password":          hash,
+			"email_verified_at": gorm.Expr("COALESCE(email_verified_at, ?)", time.Now()),
+		}).Error; err != nil {
+			return err
+		}
+		return revokeUserSessions(tx, token.UserID)
+	})
+}
+
+// ConfirmEmailChange switches the user to the address the token was issued
+// for. Opening the link proves ownership, so the new address is verified.
+func (s *Storage) ConfirmEmailChange(id uint, nonceHash string) (*models.User, error) {
+	user := new(models.User)
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		token, err := consumeUserToken(tx, id, models.TokenChangeEmail, nonceHash)
+		if err != nil {
+			return err
+		}
+		if err := emailAvailable(tx, token.NewEmail, token.UserID); err != nil {
+			return err
+		}
+		if err := tx.Model(&models.User{}).Where("id = ?", token.UserID).Updates(map[string]any{
+			"email":             token.NewEmail,
+			"email_verified_at": time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", token.UserID).First(user).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
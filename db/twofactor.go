@@ -0,0 +1,154 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"gorm.io/gorm"
+)
+
+// maxChallengeAttempts is how many wrong codes a login challenge takes before
+// the password has to be entered again.
+const maxChallengeAttempts = 5
+
+var (
+	ErrTOTPNotEnrolled   = errors.New("two-factor authentication is not set up")
+	ErrTOTPAlreadyActive = errors.New("two-factor authentication is already on")
+)
+
+//Two-Factor Authentication
+
+// BeginTOTPEnrollment stores a secret that only takes effect once
+// EnableTOTP confirms the user can produce codes from it.
+func (s *Storage) BeginTOTPEnrollment(userID uint, secret string) error {
+	res := s.db.Model(&models.User{}).
+		Where("id = ? AND totp_enabled_at IS NULL", userID).
+		Updates(map[string]any{"totp_secret": secret, "totp_last_step": 0})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrTOTPAlreadyActive
+	}
+	return nil
+}
+
+// EnableTOTP switches two-factor on, replaces the recovery codes and signs
+// out every session but keepFamily, since those never passed a second factor.
+func (s *Storage) EnableTOTP(userID uint, step int64, codeHashes []string, keepFamily string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&models.User{}).
+			Where("id = ? AND totp_enabled_at IS NULL AND totp_secret <> ''", userID).
+			Updates(map[string]any{"totp_enabled_at": time.Now(), "totp_last_step": step})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrTOTPNotEnrolled
+		}
+		if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+			return err
+		}
+		return revokeOtherSessions(tx, userID, keepFamily)
+	})
+}
+
+// DisableTOTP switches two-factor off and signs out every session but
+// keepFamily, in case it is being turned off by someone who stole one.
+func (s *Storage) DisableTOTP(userID uint, keepFamily string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]any{
+			"totp_secret":     "",
+			"totp_enabled_at": nil,
+			"totp_last_step":  0,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return revokeOtherSessions(tx, userID, keepFamily)
+	})
+}
+
+// UseTOTPStep records that the code for step was used. It fails for a step
+// at or before the last one, so every code works only once.
+func (s *Storage) UseTOTPStep(userID uint, step int64) bool {
+	res := s.db.Model(&models.User{}).
+		Where("id = ? AND totp_last_step < ?", userID, step).
+		Update("totp_last_step", step)
+	return res.Error == nil && res.RowsAffected == 1
+}
+
+func (s *Storage) ReplaceRecoveryCodes(userID uint, codeHashes []string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, userID, codeHashes)
+	})
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint, codeHashes []string) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return err
+	}
+	codes := make([]*models.RecoveryCode, len(codeHashes))
+	for i, h := range codeHashes {
+		codes[i] = &models.RecoveryCode{UserID: userID, CodeHash: h}
+	}
+	if len(codes) == 0 {
+		return nil
+	}
+	return tx.Create(&codes).Error
+}
+
+// UseRecoveryCode burns the matching unused code.
+func (s *Storage) UseRecoveryCode(userID uint, codeHash string) bool {
+	res := s.db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", time.Now())
+	return res.Error == nil && res.RowsAffected == 1
+}
+
+func (s *Storage) RecoveryCodesLeft(userID uint) (int64, error) {
+	var count int64
+	err := s.db.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// LoginChallengeUser returns the user a pending login challenge belongs to,
+// without using it up.
+func (s *Storage) LoginChallengeUser(id uint, nonceHash string) (*models.User, error) {
+	token := new(models.UserToken)
+	if err := s.db.Where("id = ? AND purpose = ? AND nonce_hash = ?", id, models.TokenLoginTwoStep, nonceHash).
+		First(token).Error; err != nil {
+		return nil, ErrUserTokenInvalid
+	}
+	if token.UsedAt != nil || time.Now().After(token.ExpiresAt) {
+		return nil, ErrUserTokenInvalid
+	}
+	user := new(models.User)
+	if err := s.db.Where("id = ?", token.UserID).First(user).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// FailLoginChallenge counts a wrong code and retires the challenge once it
+// has seen too many.
+func (s *Storage) FailLoginChallenge(id uint) error {
+	return s.db.Model(&models.UserToken{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Updates(map[string]any{
+			"attempts": gorm.Expr("attempts + 1"),
+			"used_at":  gorm.Expr("CASE WHEN attempts + 1 >= ? THEN ? ELSE NULL END", maxChallengeAttempts, time.Now()),
+		}).Error
+}
+
+// CompleteLoginChallenge uses up a challenge after the second factor checked
+// out.
+func (s *Storage) CompleteLoginChallenge(id uint, nonceHash string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		_, err := consumeUserToken(tx, id, models.TokenLoginTwoStep, nonceHash)
+		return err
+	})
+}
@@ -0,0 +1,129 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db"
+	"github.com/SourishBeast7/Glooo/db/models"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/gorilla/mux"
+)
+
+// Chat state
+
+func (s *Server) handleChatApiRoutes(router *mux.Router) {
+	router.HandleFunc("/{id}/read", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		chatID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		var body struct {
+			MessageID uint `json:"message_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		changed, err := s.store.MarkChatRead(chatID, p.UserID, body.MessageID)
+		if err != nil {
+			return err
+		}
+		if changed {
+			s.hub.PublishRead(chatID, p.UserID, body.MessageID, nil)
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/{id}/attachments", m.AuthMiddleWare(s.store, m.RequireVerified(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		chatID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		if !s.store.IsChatMember(chatID, p.UserID) {
+			return db.ErrNotChatMember
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.media.MaxBytes+(1<<20))
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		obj, err := s.uploadFilesToCdn(r.Context(), file, attachmentFolder, header.Filename)
+		if err != nil {
+			return err
+		}
+		attachment := &models.Attachment{
+			ChatID:     chatID,
+			UploaderID: p.UserID,
+			FileName:   filepath.Base(header.Filename),
+			MIMEType:   obj.ContentType,
+			Size:       obj.Size,
+			StorageKey: obj.Key,
+			Width:      obj.Width,
+			Height:     obj.Height,
+		}
+		if err := s.store.CreateAttachment(attachment); err != nil {
+			s.media.Store.Delete(r.Context(), obj.Key)
+			return err
+		}
+		return WriteJson(w, http.StatusCreated, Response{
+			"success":    true,
+			"attachment": attachment,
+		})
+	})))).Methods(http.MethodPost)
+
+	router.HandleFunc("/{id}/mute", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		chatID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		// An empty body or no "until" mutes until further notice.
+		var body struct {
+			Until *time.Time `json:"until"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if err := s.store.MuteChat(chatID, p.UserID, body.Until); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/{id}/mute", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		chatID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		if err := s.store.UnmuteChat(chatID, p.UserID); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodDelete)
+}
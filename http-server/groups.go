@@ -0,0 +1,175 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/gorilla/mux"
+)
+
+// pathID reads a numeric mux variable such as {id}.
+func pathID(r *http.Request, name string) (uint, error) {
+	id := StringToUint(mux.Vars(r)[name])
+	if id == 0 {
+		return 0, errors.New("invalid " + name)
+	}
+	return id, nil
+}
+
+// Group chats
+
+func (s *Server) handleGroupRoutes(router *mux.Router) {
+	router.HandleFunc("", m.AuthMiddleWare(s.store, m.RequireVerified(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		req := new(models.CreateGroup)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return err
+		}
+		chat, err := s.store.CreateGroupChat(p.UserID, req.Name, req.MemberIDs)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusCreated, Response{
+			"success": true,
+			"chat":    chat,
+		})
+	})))).Methods(http.MethodPost)
+
+	router.HandleFunc("/{id}", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		chatID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		if err := s.store.RenameGroup(chatID, p.UserID, body.Name); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPatch)
+
+	router.HandleFunc("/{id}/members", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		chatID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		if !s.store.IsChatMember(chatID, p.UserID) {
+			return errors.New("chat not found")
+		}
+		members, err := s.store.GetChatMembers(chatID)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"members": members,
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/{id}/members", m.AuthMiddleWare(s.store, m.RequireVerified(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		chatID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		var body struct {
+			UserIDs []uint `json:"user_ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		if err := s.store.AddGroupMembers(chatID, p.UserID, body.UserIDs); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	})))).Methods(http.MethodPost)
+
+	router.HandleFunc("/{id}/members/{user_id}", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		chatID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		userID, err := pathID(r, "user_id")
+		if err != nil {
+			return err
+		}
+		if err := s.store.RemoveGroupMember(chatID, p.UserID, userID); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodDelete)
+
+	router.HandleFunc("/{id}/members/{user_id}", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		chatID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		userID, err := pathID(r, "user_id")
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		if err := s.store.SetGroupMemberRole(chatID, p.UserID, userID, body.Role); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPatch)
+
+	router.HandleFunc("/{id}/leave", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		chatID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		if err := s.store.LeaveGroup(chatID, p.UserID); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+}
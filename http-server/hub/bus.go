@@ -0,0 +1,73 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Delivery is a frame addressed to users who may be connected to any node.
+type Delivery struct {
+	UserIDs []uint    `json:"user_ids"`
+	Event   *Envelope `json:"event"`
+	// SkipConn is the connection the event originated from, if any. Connection
+	// IDs are random, so it only ever matches on the publishing node.
+	SkipConn string `json:"skip_conn,omitempty"`
+}
+
+// Bus carries deliveries between hub replicas. Every hub, including the one
+// that published, receives each delivery through its subscription and hands
+// it to whichever of the users are connected locally.
+type Bus interface {
+	Publish(ctx context.Context, d *Delivery) error
+	Subscribe(handler func(*Delivery)) error
+	Close() error
+}
+
+// NewBusFromEnv picks the bus named by HUB_BUS: "memory" (the default, single
+// node only) or "postgres", which uses LISTEN/NOTIFY on DB_URL.
+func NewBusFromEnv(ctx context.Context) (Bus, error) {
+	switch kind := os.Getenv("HUB_BUS"); kind {
+	case "", "memory":
+		return NewMemoryBus(), nil
+	case "postgres":
+		channel := os.Getenv("HUB_BUS_CHANNEL")
+		if channel == "" {
+			channel = "glooo_hub"
+		}
+		return NewPostgresBus(ctx, os.Getenv("DB_URL"), channel)
+	default:
+		return nil, fmt.Errorf("unknown HUB_BUS %q", kind)
+	}
+}
+
+// MemoryBus delivers in process and is enough when running a single replica.
+type MemoryBus struct {
+	mu       sync.RWMutex
+	handlers []func(*Delivery)
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{}
+}
+
+func (b *MemoryBus) Publish(_ context.Context, d *Delivery) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(d)
+	}
+	return nil
+}
+
+func (b *MemoryBus) Subscribe(handler func(*Delivery)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func (b *MemoryBus) Close() error {
+	return nil
+}
@@ -0,0 +1,135 @@
+package hub
+
+import (
+	"log"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+)
+
+func (h *Hub) handleMessageEdit(c *Client, e *Envelope) error {
+	p := new(MessageEditPayload)
+	if err := e.Decode(p); err != nil {
+		return err
+	}
+	content, err := ValidateContent(p.Content)
+	if err != nil {
+		return err
+	}
+	message, err := h.db.EditMessage(c.ID, p.MessageID, content)
+	if err != nil {
+		return err
+	}
+	h.PublishMessageEdited(message, nil)
+	return nil
+}
+
+func (h *Hub) handleMessageDelete(c *Client, e *Envelope) error {
+	p := new(MessageDeletePayload)
+	if err := e.Decode(p); err != nil {
+		return err
+	}
+	var (
+		message *models.Message
+		err     error
+	)
+	switch p.Scope {
+	case models.DeleteForMe:
+		message, err = h.db.DeleteMessageForMe(c.ID, p.MessageID)
+	case models.DeleteForEveryone:
+		message, err = h.db.DeleteMessageForEveryone(c.ID, p.MessageID)
+	default:
+		return NewProtocolError(ErrCodeInvalidPayload, "scope must be me or everyone")
+	}
+	if err != nil {
+		return err
+	}
+	h.PublishMessageDeleted(message, p.Scope, c.ID, nil)
+	return nil
+}
+
+// PublishMessageEdited sends the new version of a message to every member of
+// its chat, including all of the editor's devices.
+func (h *Hub) PublishMessageEdited(message *models.Message, origin *Client) {
+	members, err := h.db.ChatMemberIDs(message.ChatID)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	e, err := NewEnvelope(EventMessageEdited, "", message)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	h.DeliverFrom(message.SenderID, members, e, origin)
+}
+
+// PublishMessageDeleted tells clients to drop a message. Deletions for
+// everyone go to the whole chat, deletions for me only to userID's devices.
+func (h *Hub) PublishMessageDeleted(message *models.Message, scope string, userID uint, origin *Client) {
+	recipients := []uint{userID}
+	if scope == models.DeleteForEveryone {
+		members, err := h.db.ChatMemberIDs(message.ChatID)
+		if err != nil {
+			log.Printf("%v", err)
+			return
+		}
+		recipients = members
+	}
+	e, err := NewEnvelope(EventMessageDeleted, "", MessageDeletePayload{
+		MessageID: message.ID,
+		ChatID:    message.ChatID,
+		Scope:     scope,
+	})
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	h.DeliverFrom(userID, recipients, e, origin)
+}
+
+func (h *Hub) handleReaction(c *Client, e *Envelope) error {
+	p := new(ReactionPayload)
+	if err := e.Decode(p); err != nil {
+		return err
+	}
+	var (
+		message *models.Message
+		err     error
+	)
+	added := e.Type == EventReactionAdd
+	if added {
+		message, err = h.db.AddReaction(c.ID, p.MessageID, p.Emoji)
+	} else {
+		message, err = h.db.RemoveReaction(c.ID, p.MessageID, p.Emoji)
+	}
+	if err != nil {
+		return err
+	}
+	h.PublishReaction(message, c.ID, p.Emoji, added)
+	return nil
+}
+
+// PublishReaction tells every member of the chat that userID added or
+// removed a reaction.
+func (h *Hub) PublishReaction(message *models.Message, userID uint, emoji string, added bool) {
+	members, err := h.db.ChatMemberIDs(message.ChatID)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	eventType := EventReactionRemoved
+	if added {
+		eventType = EventReactionAdded
+	}
+	e, err := NewEnvelope(eventType, "", ReactionPayload{
+		MessageID: message.ID,
+		ChatID:    message.ChatID,
+		UserID:    userID,
+		Emoji:     emoji,
+	})
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	h.DeliverFrom(userID, members, e, nil)
+}
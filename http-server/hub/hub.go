@@ -1,62 +1,173 @@
 package hub
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/SourishBeast7/Glooo/db"
 	"github.com/SourishBeast7/Glooo/db/models"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// Time allowed to write a frame to the peer.
+	writeWait = 10 * time.Second
+	// Time allowed between pongs before the peer is considered dead.
+	pongWait = 60 * time.Second
+	// Pings go out a little more often than pongWait.
+	pingPeriod = (pongWait * 9) / 10
+	// Largest frame a client may send.
+	maxFrameSize = 64 << 10
+	// Outbound frames queued per client before it counts as a slow consumer.
+	sendBufferSize = 256
+)
+
+var ErrClientClosed = errors.New("client connection closed")
+
 type Client struct {
 	ID   uint
 	Conn *websocket.Conn
 	Hub  *Hub
+	// Verified users have confirmed their email address; others may not
+	// send messages yet.
+	Verified bool
+	// connID identifies this connection on the bus.
+	connID string
+
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 type Hub struct {
-	Clients    map[uint]*Client
+	// Clients holds every open connection per user ID, one per device.
+	Clients    map[uint]map[*Client]struct{}
 	Register   chan *Client
 	Unregister chan *Client
 	Broadcast  chan []byte
 	Mutex      sync.RWMutex
 	db         *db.Storage
+	handlers   map[string]HandlerFunc
+	bus        Bus
+	typing     *typingTracker
+	listener   MessageListener
+
+	// node identifies this replica in the presence table.
+	node       string
+	presenceMu sync.Mutex
+	// announced holds the users this node has a presence row for.
+	announced map[uint]bool
+}
+
+// MessageListener is told about every new message and who it went to, so
+// that recipients who are away can be reached some other way.
+type MessageListener interface {
+	MessageStored(message *models.Message, recipients []uint)
+}
+
+// SetMessageListener must be called before Run.
+func (h *Hub) SetMessageListener(l MessageListener) {
+	h.listener = l
 }
 
 func (h *Hub) NewClient(id uint, conn *websocket.Conn) *Client {
 	return &Client{
-		ID:   id,
-		Conn: conn,
-		Hub:  h,
+		ID:     id,
+		Conn:   conn,
+		Hub:    h,
+		connID: newConnID(),
+		send:   make(chan []byte, sendBufferSize),
+		done:   make(chan struct{}),
 	}
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		Clients:    make(map[uint]*Client),
+func newConnID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// NewHub creates a hub that exchanges deliveries with other replicas over
+// bus. A nil bus keeps everything in process.
+func NewHub(bus Bus) *Hub {
+	if bus == nil {
+		bus = NewMemoryBus()
+	}
+	h := &Hub{
+		Clients:    make(map[uint]map[*Client]struct{}),
 		Register:   make(chan *Client),
 		Unregister: make(chan *Client),
 		Broadcast:  make(chan []byte),
+		handlers:   make(map[string]HandlerFunc),
+		bus:        bus,
+		node:       newConnID(),
+		announced:  make(map[uint]bool),
 	}
+	h.typing = newTypingTracker(h.typingExpired)
+	h.On(EventMessageSend, h.handleMessageSend)
+	h.On(EventMessageAck, h.handleDeliveryAck)
+	h.On(EventRead, h.handleRead)
+	h.On(EventTyping, h.handleTyping)
+	h.On(EventMessageEdit, h.handleMessageEdit)
+	h.On(EventMessageDelete, h.handleMessageDelete)
+	h.On(EventReactionAdd, h.handleReaction)
+	h.On(EventReactionRemove, h.handleReaction)
+	return h
+}
+
+// On registers fn as the handler for client events of the given type.
+func (h *Hub) On(eventType string, fn HandlerFunc) {
+	h.handlers[eventType] = fn
 }
 
 func (h *Hub) Run(db *db.Storage) {
 	h.db = db
+	if err := h.bus.Subscribe(h.deliverLocal); err != nil {
+		log.Printf("hub: bus subscribe: %v", err)
+	}
+	go h.presenceLoop(context.Background())
 	for {
 		select {
 		case client := <-h.Register:
 			h.Mutex.Lock()
-			h.Clients[client.ID] = client
+			conns, ok := h.Clients[client.ID]
+			if !ok {
+				conns = make(map[*Client]struct{})
+				h.Clients[client.ID] = conns
+			}
+			conns[client] = struct{}{}
 			h.Mutex.Unlock()
+			if !ok {
+				go h.presenceChanged(client.ID)
+			}
+			go h.sendPresenceSnapshot(client)
+			go h.pushUndelivered(client)
 		case client := <-h.Unregister:
 			h.Mutex.Lock()
-			if _, ok := h.Clients[client.ID]; ok {
-				h.Mutex.Lock()
-				delete(h.Clients, client.ID)
-				h.Mutex.Unlock()
+			last := false
+			if conns, ok := h.Clients[client.ID]; ok {
+				if _, ok := conns[client]; ok {
+					delete(conns, client)
+					last = len(conns) == 0
+				}
+				if last {
+					delete(h.Clients, client.ID)
+				}
 			}
 			h.Mutex.Unlock()
+			client.Close()
+			if last {
+				go h.presenceChanged(client.ID)
+			}
 		}
 	}
 }
@@ -65,30 +176,336 @@ func (h *Hub) Readloop(c *Client) {
 	defer func() {
 		h.Unregister <- c
 	}()
+	c.Conn.SetReadLimit(maxFrameSize)
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
 	for {
-		message := new(models.Message)
-		message.SenderID = c.ID
-		err := c.Conn.ReadJSON(message)
+		_, data, err := c.Conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseInvalidFramePayloadData) {
-				h.Unregister <- c
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println(err)
+			}
+			return
+		}
+		h.dispatch(c, data)
+	}
+}
+
+func (h *Hub) dispatch(c *Client, data []byte) {
+	e := new(Envelope)
+	if err := json.Unmarshal(data, e); err != nil {
+		c.SendError("", NewProtocolError(ErrCodeBadFrame, "frame is not a valid envelope"))
+		return
+	}
+	if e.V != 0 && e.V != ProtocolVersion {
+		c.SendError(e.ID, NewProtocolError(ErrCodeUnsupportedVersion, "unsupported protocol version"))
+		return
+	}
+	handler, ok := h.handlers[e.Type]
+	if !ok {
+		c.SendError(e.ID, NewProtocolError(ErrCodeUnknownType, "unknown event type "+e.Type))
+		return
+	}
+	if err := handler(c, e); err != nil {
+		log.Printf("hub: %s from user %d: %v", e.Type, c.ID, err)
+		c.SendError(e.ID, err)
+	}
+}
+
+// WritePump drains the client's send queue onto the connection and keeps it
+// alive with pings. It is the only goroutine that writes to Conn.
+func (c *Client) WritePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
+	for {
+		select {
+		case data := <-c.send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				c.Close()
 				return
 			}
-			log.Println(err)
-			continue
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+	}
+}
+
+// Close stops the write pump and closes the connection, which in turn ends
+// the read loop and unregisters the client. It is safe to call repeatedly.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// Send queues an envelope for the write pump. A client whose queue is full is
+// too slow to keep up and gets disconnected rather than blocking the sender.
+func (c *Client) Send(e *Envelope) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	default:
+	}
+	select {
+	case c.send <- data:
+		return nil
+	default:
+		log.Printf("hub: dropping slow client for user %d", c.ID)
+		c.Close()
+		return ErrClientClosed
+	}
+}
+
+func (c *Client) SendEvent(eventType string, id string, payload any) error {
+	e, err := NewEnvelope(eventType, id, payload)
+	if err != nil {
+		return err
+	}
+	return c.Send(e)
+}
+
+func (c *Client) SendError(id string, err error) {
+	if err := c.SendEvent(EventError, id, errorPayload(err)); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// ValidateContent trims message text and checks it is neither empty nor too long.
+func ValidateContent(content string) (string, error) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return "", NewProtocolError(ErrCodeInvalidPayload, "content is required")
+	}
+	if len(content) > maxMessageLength {
+		return "", NewProtocolError(ErrCodeInvalidPayload, "content is too long")
+	}
+	return content, nil
+}
+
+func (h *Hub) handleMessageSend(c *Client, e *Envelope) error {
+	if !c.Verified {
+		return NewProtocolError(ErrCodeRejected, "confirm your email address before sending messages")
+	}
+	p := new(MessageSendPayload)
+	if err := e.Decode(p); err != nil {
+		return err
+	}
+	// Messages that only carry attachments may have no text.
+	content := strings.TrimSpace(p.Content)
+	if content != "" || len(p.AttachmentIDs) == 0 {
+		var err error
+		if content, err = ValidateContent(p.Content); err != nil {
+			return err
 		}
-		h.db.AddMessages(message)
-		go h.WriteMessage(message)
 	}
+	// The sender is always the authenticated connection, never the payload.
+	message := &models.Message{
+		Content:       content,
+		ChatID:        p.ChatID,
+		SenderID:      c.ID,
+		ReceiverID:    p.ReceiverID,
+		ReplyToID:     p.ReplyToID,
+		AttachmentIDs: p.AttachmentIDs,
+	}
+	if err := h.db.AddMessages(message); err != nil {
+		return err
+	}
+	if err := c.SendEvent(EventMessageAck, e.ID, MessageAckPayload{
+		MessageID: message.ID,
+		ChatID:    message.ChatID,
+		CreatedAt: message.CreatedAt,
+	}); err != nil {
+		log.Printf("%v", err)
+	}
+	go h.WriteMessage(message, c)
+	return nil
 }
 
-func (h *Hub) WriteMessage(message *models.Message) {
-	h.Mutex.Lock()
-	if c, ok := h.Clients[message.ReceiverID]; ok {
-		if err := c.Conn.WriteJSON(message); err != nil {
-			log.Printf("%v", err)
+// pushUndelivered replays messages that arrived while the user had no
+// device connected. They stay pending until the client acks them.
+func (h *Hub) pushUndelivered(c *Client) {
+	messages, err := h.db.UndeliveredMessages(c.ID)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	for _, message := range messages {
+		if err := c.SendEvent(EventMessageNew, "", message); err != nil {
 			return
 		}
 	}
-	h.Mutex.Unlock()
+}
+
+func (h *Hub) handleDeliveryAck(c *Client, e *Envelope) error {
+	p := new(DeliveryAckPayload)
+	if err := e.Decode(p); err != nil {
+		return err
+	}
+	delivered, err := h.db.MarkMessagesDelivered(c.ID, p.MessageIDs)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, message := range delivered {
+		status, err := NewEnvelope(EventMessageStatus, "", MessageStatusPayload{
+			MessageID: message.ID,
+			ChatID:    message.ChatID,
+			UserID:    c.ID,
+			Status:    models.DeliveryDelivered,
+			At:        now,
+		})
+		if err != nil {
+			return err
+		}
+		h.DeliverFrom(c.ID, []uint{message.SenderID}, status, nil)
+	}
+	return nil
+}
+
+func (h *Hub) handleRead(c *Client, e *Envelope) error {
+	p := new(ReadPayload)
+	if err := e.Decode(p); err != nil {
+		return err
+	}
+	changed, err := h.db.MarkChatRead(p.ChatID, c.ID, p.MessageID)
+	if err != nil {
+		return err
+	}
+	if changed {
+		h.PublishRead(p.ChatID, c.ID, p.MessageID, c)
+	}
+	return nil
+}
+
+// PublishRead sends a read receipt for userID to everyone in the chat,
+// including the reader's other devices so they can clear their badges.
+func (h *Hub) PublishRead(chatID uint, userID uint, messageID uint, origin *Client) {
+	members, err := h.db.ChatMemberIDs(chatID)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	e, err := NewEnvelope(EventRead, "", ReadPayload{
+		ChatID:    chatID,
+		UserID:    userID,
+		MessageID: messageID,
+	})
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	h.DeliverFrom(userID, members, e, origin)
+}
+
+// PublishNotification pushes a freshly stored inbox entry to its owner.
+func (h *Hub) PublishNotification(n *models.Notification) {
+	e, err := NewEnvelope(EventNotification, "", n)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	h.Deliver([]uint{n.UserID}, e, nil)
+}
+
+// Deliver publishes e to every device of the given users, whichever node
+// they are connected to. skip, if set, is the originating connection.
+func (h *Hub) Deliver(userIDs []uint, e *Envelope, skip *Client) {
+	if len(userIDs) == 0 {
+		return
+	}
+	d := &Delivery{UserIDs: userIDs, Event: e}
+	if skip != nil {
+		d.SkipConn = skip.connID
+	}
+	if err := h.bus.Publish(context.Background(), d); err != nil {
+		log.Printf("hub: publish: %v", err)
+	}
+}
+
+// DeliverFrom is Deliver for events caused by user from. Users with a block
+// in either direction with from never receive them.
+func (h *Hub) DeliverFrom(from uint, userIDs []uint, e *Envelope, skip *Client) {
+	userIDs, err := h.unblocked(from, userIDs)
+	if err != nil {
+		log.Printf("hub: %v", err)
+		return
+	}
+	h.Deliver(userIDs, e, skip)
+}
+
+// unblocked drops the users that have a block with from in either direction.
+func (h *Hub) unblocked(from uint, userIDs []uint) ([]uint, error) {
+	blocked, err := h.db.BlockedAmong(from, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocked) == 0 {
+		return userIDs, nil
+	}
+	allowed := make([]uint, 0, len(userIDs))
+	for _, id := range userIDs {
+		if !blocked[id] {
+			allowed = append(allowed, id)
+		}
+	}
+	return allowed, nil
+}
+
+// deliverLocal hands a delivery from the bus to the connections on this node.
+func (h *Hub) deliverLocal(d *Delivery) {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	for _, id := range d.UserIDs {
+		for c := range h.Clients[id] {
+			if d.SkipConn != "" && c.connID == d.SkipConn {
+				continue
+			}
+			if err := c.Send(d.Event); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+}
+
+// WriteMessage fans message out to every device of every member of its chat,
+// including the sender's other devices. origin is the connection it was sent
+// from, which already got an ack instead.
+func (h *Hub) WriteMessage(message *models.Message, origin *Client) {
+	members, err := h.db.ChatMemberIDs(message.ChatID)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	e, err := NewEnvelope(EventMessageNew, "", message)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	members, err = h.unblocked(message.SenderID, members)
+	if err != nil {
+		log.Printf("hub: %v", err)
+		return
+	}
+	h.Deliver(members, e, origin)
+	if h.listener != nil {
+		h.listener.MessageStored(message, members)
+	}
 }
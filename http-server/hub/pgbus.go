@@ -0,0 +1,196 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// NOTIFY payloads must stay under 8000 bytes; bigger deliveries are
+	// parked in hub_bus_payloads and only their row ID is notified.
+	maxNotifyPayload  = 7900
+	payloadRetention  = 5 * time.Minute
+	reconnectBackoff  = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+type notification struct {
+	Delivery *Delivery `json:"d,omitempty"`
+	Ref      int64     `json:"ref,omitempty"`
+}
+
+// PostgresBus fans deliveries out to every replica with LISTEN/NOTIFY.
+type PostgresBus struct {
+	dsn     string
+	channel string
+	pool    *pgxpool.Pool
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mu       sync.RWMutex
+	handlers []func(*Delivery)
+	started  bool
+}
+
+func NewPostgresBus(ctx context.Context, dsn string, channel string) (*PostgresBus, error) {
+	if dsn == "" {
+		return nil, errors.New("postgres bus: DB_URL is not set")
+	}
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS hub_bus_payloads (
+		id BIGSERIAL PRIMARY KEY,
+		payload TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &PostgresBus{
+		dsn:     dsn,
+		channel: channel,
+		pool:    pool,
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+func (b *PostgresBus) Publish(ctx context.Context, d *Delivery) error {
+	payload, err := json.Marshal(notification{Delivery: d})
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxNotifyPayload {
+		raw, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		var ref int64
+		if err := b.pool.QueryRow(ctx, "INSERT INTO hub_bus_payloads (payload) VALUES ($1) RETURNING id", string(raw)).Scan(&ref); err != nil {
+			return err
+		}
+		if payload, err = json.Marshal(notification{Ref: ref}); err != nil {
+			return err
+		}
+	}
+	_, err = b.pool.Exec(ctx, "SELECT pg_notify($1, $2)", b.channel, string(payload))
+	return err
+}
+
+// Subscribe registers handler and, on first use, starts listening.
+func (b *PostgresBus) Subscribe(handler func(*Delivery)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+	if !b.started {
+		b.started = true
+		go b.listen()
+		go b.prune()
+	}
+	return nil
+}
+
+func (b *PostgresBus) Close() error {
+	b.cancel()
+	b.pool.Close()
+	return nil
+}
+
+// listen holds a dedicated connection in LISTEN and reconnects with backoff
+// whenever it drops.
+func (b *PostgresBus) listen() {
+	delay := reconnectBackoff
+	for b.ctx.Err() == nil {
+		listened, err := b.listenOnce()
+		if b.ctx.Err() != nil {
+			return
+		}
+		// A connection that got as far as LISTEN was healthy, so the next
+		// failure starts the backoff over.
+		if listened {
+			delay = reconnectBackoff
+		}
+		log.Printf("hub bus: listener stopped: %v; reconnecting in %s", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-b.ctx.Done():
+			return
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// listenOnce runs one listening connection until it fails. It reports
+// whether LISTEN went through before the failure.
+func (b *PostgresBus) listenOnce() (bool, error) {
+	conn, err := pgx.Connect(b.ctx, b.dsn)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(b.ctx, "LISTEN "+pgx.Identifier{b.channel}.Sanitize()); err != nil {
+		return false, err
+	}
+	log.Printf("📡 Hub bus listening on %q", b.channel)
+	for {
+		n, err := conn.WaitForNotification(b.ctx)
+		if err != nil {
+			return true, err
+		}
+		d, err := b.decode(n.Payload)
+		if err != nil {
+			log.Printf("hub bus: %v", err)
+			continue
+		}
+		b.mu.RLock()
+		for _, handler := range b.handlers {
+			handler(d)
+		}
+		b.mu.RUnlock()
+	}
+}
+
+func (b *PostgresBus) decode(payload string) (*Delivery, error) {
+	n := new(notification)
+	if err := json.Unmarshal([]byte(payload), n); err != nil {
+		return nil, err
+	}
+	if n.Delivery != nil {
+		return n.Delivery, nil
+	}
+	var raw string
+	if err := b.pool.QueryRow(b.ctx, "SELECT payload FROM hub_bus_payloads WHERE id = $1", n.Ref).Scan(&raw); err != nil {
+		return nil, err
+	}
+	d := new(Delivery)
+	if err := json.Unmarshal([]byte(raw), d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// prune drops parked payloads once every replica has had time to read them.
+func (b *PostgresBus) prune() {
+	ticker := time.NewTicker(payloadRetention)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := b.pool.Exec(b.ctx, "DELETE FROM hub_bus_payloads WHERE created_at < now() - make_interval(secs => $1)", payloadRetention.Seconds()); err != nil {
+				log.Printf("hub bus: %v", err)
+			}
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
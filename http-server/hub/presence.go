@@ -0,0 +1,265 @@
+package hub
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// typingTimeout is how long a typing indicator lasts without a refresh.
+	typingTimeout = 6 * time.Second
+	// presenceHeartbeat is how often a node refreshes its presence rows. It
+	// has to stay well under db.PresenceTTL.
+	presenceHeartbeat = 30 * time.Second
+)
+
+// Typing state only ever lives in memory and on the wire. Presence is shared
+// between replicas through the database: each node keeps a row per user it
+// holds a connection for, so a user is only announced offline once no live
+// node has them. If a node dies its users go offline silently when its rows
+// expire.
+
+func (h *Hub) isOnline(userID uint) bool {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	return len(h.Clients[userID]) > 0
+}
+
+// presenceChanged brings the user's presence row on this node in line with
+// their local connections and tells friends when that changed their overall
+// state. It reads the current state rather than trusting the caller, so
+// calls that race each other still settle correctly.
+func (h *Hub) presenceChanged(userID uint) {
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+	online := h.isOnline(userID)
+	if online == h.announced[userID] {
+		return
+	}
+	if online {
+		h.announced[userID] = true
+		first, err := h.db.AddPresence(h.node, userID)
+		if err != nil {
+			log.Printf("presence: %v", err)
+		}
+		if first || err != nil {
+			h.userOnline(userID)
+		}
+		return
+	}
+	delete(h.announced, userID)
+	for _, chatID := range h.typing.clearUser(userID) {
+		h.publishTyping(chatID, userID, TypingStop)
+	}
+	last, err := h.db.RemovePresence(h.node, userID)
+	if err != nil {
+		log.Printf("presence: %v", err)
+	}
+	if last || err != nil {
+		h.userOffline(userID)
+	}
+}
+
+// presenceLoop refreshes this node's presence rows until ctx is cancelled.
+func (h *Hub) presenceLoop(ctx context.Context) {
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.presenceMu.Lock()
+			users := make([]uint, 0, len(h.announced))
+			for id := range h.announced {
+				users = append(users, id)
+			}
+			err := h.db.SyncPresence(h.node, users)
+			h.presenceMu.Unlock()
+			if err != nil {
+				log.Printf("presence: %v", err)
+			}
+		}
+	}
+}
+
+// userOnline tells the user's friends that their first device connected.
+func (h *Hub) userOnline(userID uint) {
+	h.publishPresence(userID, PresencePayload{UserID: userID, Status: PresenceOnline})
+}
+
+// userOffline records when the user's last device disconnected and tells
+// their friends.
+func (h *Hub) userOffline(userID uint) {
+	now := time.Now()
+	if err := h.db.UpdateLastSeen(userID, now); err != nil {
+		log.Printf("%v", err)
+	}
+	h.publishPresence(userID, PresencePayload{UserID: userID, Status: PresenceOffline, LastSeen: &now})
+}
+
+func (h *Hub) publishPresence(userID uint, p PresencePayload) {
+	friends, err := h.db.FriendIDs(userID)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	e, err := NewEnvelope(EventPresence, "", p)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	h.DeliverFrom(userID, friends, e, nil)
+}
+
+// sendPresenceSnapshot gives a new connection the current state of every
+// friend, wherever they are connected.
+func (h *Hub) sendPresenceSnapshot(c *Client) {
+	friends, err := h.db.GetFriends(c.ID)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	ids := make([]uint, len(friends))
+	for i, friend := range friends {
+		ids[i] = friend.ID
+	}
+	online, err := h.db.OnlineAmong(ids)
+	if err != nil {
+		log.Printf("presence: %v", err)
+		online = make(map[uint]bool)
+	}
+	for _, friend := range friends {
+		p := PresencePayload{UserID: friend.ID, Status: PresenceOffline, LastSeen: friend.LastSeen}
+		if online[friend.ID] || h.isOnline(friend.ID) {
+			p = PresencePayload{UserID: friend.ID, Status: PresenceOnline}
+		}
+		if err := c.SendEvent(EventPresence, "", p); err != nil {
+			return
+		}
+	}
+}
+
+func (h *Hub) handleTyping(c *Client, e *Envelope) error {
+	p := new(TypingPayload)
+	if err := e.Decode(p); err != nil {
+		return err
+	}
+	if !h.db.IsChatMember(p.ChatID, c.ID) {
+		return NewProtocolError(ErrCodeRejected, "not a member of this chat")
+	}
+	switch p.State {
+	case TypingStart:
+		if h.typing.start(p.ChatID, c.ID) {
+			h.publishTyping(p.ChatID, c.ID, TypingStart)
+		}
+	case TypingStop:
+		if h.typing.stop(p.ChatID, c.ID) {
+			h.publishTyping(p.ChatID, c.ID, TypingStop)
+		}
+	default:
+		return NewProtocolError(ErrCodeInvalidPayload, "state must be start or stop")
+	}
+	return nil
+}
+
+func (h *Hub) typingExpired(chatID uint, userID uint) {
+	h.publishTyping(chatID, userID, TypingStop)
+}
+
+// publishTyping tells the chat's other members that userID started or
+// stopped typing.
+func (h *Hub) publishTyping(chatID uint, userID uint, state string) {
+	members, err := h.db.ChatMemberIDs(chatID)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	others := make([]uint, 0, len(members))
+	for _, id := range members {
+		if id != userID {
+			others = append(others, id)
+		}
+	}
+	e, err := NewEnvelope(EventTyping, "", TypingPayload{ChatID: chatID, UserID: userID, State: state})
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	h.DeliverFrom(userID, others, e, nil)
+}
+
+type typingKey struct {
+	chatID uint
+	userID uint
+}
+
+// typingTracker expires typing indicators that were never stopped, e.g.
+// because the client went quiet.
+type typingTracker struct {
+	mu      sync.Mutex
+	timers  map[typingKey]*time.Timer
+	expired func(chatID uint, userID uint)
+}
+
+func newTypingTracker(expired func(chatID uint, userID uint)) *typingTracker {
+	return &typingTracker{
+		timers:  make(map[typingKey]*time.Timer),
+		expired: expired,
+	}
+}
+
+// start (re)arms the indicator and reports whether it was newly started.
+func (t *typingTracker) start(chatID uint, userID uint) bool {
+	key := typingKey{chatID, userID}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if timer, ok := t.timers[key]; ok && timer.Stop() {
+		timer.Reset(typingTimeout)
+		return false
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(typingTimeout, func() {
+		t.mu.Lock()
+		current, ok := t.timers[key]
+		if ok && current == timer {
+			delete(t.timers, key)
+		}
+		t.mu.Unlock()
+		if ok && current == timer {
+			t.expired(chatID, userID)
+		}
+	})
+	t.timers[key] = timer
+	return true
+}
+
+// stop clears the indicator and reports whether one was active.
+func (t *typingTracker) stop(chatID uint, userID uint) bool {
+	key := typingKey{chatID, userID}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timer, ok := t.timers[key]
+	if ok {
+		timer.Stop()
+		delete(t.timers, key)
+	}
+	return ok
+}
+
+// clearUser stops every indicator for userID and returns the affected chats.
+func (t *typingTracker) clearUser(userID uint) []uint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	chats := make([]uint, 0)
+	for key, timer := range t.timers {
+		if key.userID == userID {
+			timer.Stop()
+			delete(t.timers, key)
+			chats = append(chats, key.chatID)
+		}
+	}
+	return chats
+}
@@ -0,0 +1,186 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ProtocolVersion is the envelope version this server speaks. Frames without
+// a version are treated as the current one.
+const ProtocolVersion = 1
+
+// Event types carried in Envelope.Type.
+const (
+	EventMessageSend     = "message.send"     // client -> server
+	EventMessageNew      = "message.new"      // server -> client
+	EventMessageStatus   = "message.status"   // server -> client
+	EventMessageEdit     = "message.edit"     // client -> server
+	EventMessageEdited   = "message.edited"   // server -> client
+	EventMessageDelete   = "message.delete"   // client -> server
+	EventMessageDeleted  = "message.deleted"  // server -> client
+	EventReactionAdd     = "reaction.add"     // client -> server
+	EventReactionAdded   = "reaction.added"   // server -> client
+	EventReactionRemove  = "reaction.remove"  // client -> server
+	EventReactionRemoved = "reaction.removed" // server -> client
+	EventNotification    = "notification"     // server -> client
+	// message.ack confirms a message.send to the sending connection, and is
+	// sent by clients to confirm message.new frames they have received.
+	EventMessageAck = "message.ack"
+	EventTyping     = "typing"
+	EventRead       = "read"
+	EventPresence   = "presence"
+	EventError      = "error"
+)
+
+// Error codes sent in ErrorPayload.Code.
+const (
+	ErrCodeBadFrame           = "bad_frame"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidPayload     = "invalid_payload"
+	ErrCodeRejected           = "rejected"
+	ErrCodeInternal           = "internal"
+)
+
+const maxMessageLength = 4000
+
+// Envelope wraps every frame sent over the socket. ID is chosen by the client
+// and echoed back on replies so requests can be matched to acks and errors.
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func NewEnvelope(eventType string, id string, payload any) (*Envelope, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		V:       ProtocolVersion,
+		Type:    eventType,
+		ID:      id,
+		Payload: raw,
+	}, nil
+}
+
+// Decode unmarshals the payload into v, reporting failures as invalid_payload.
+func (e *Envelope) Decode(v any) error {
+	if len(e.Payload) == 0 {
+		return NewProtocolError(ErrCodeInvalidPayload, "payload is required")
+	}
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return NewProtocolError(ErrCodeInvalidPayload, err.Error())
+	}
+	return nil
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ProtocolError is returned by handlers to send a specific error code back to
+// the client. Any other error is reported as "rejected".
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func NewProtocolError(code string, message string) *ProtocolError {
+	return &ProtocolError{Code: code, Message: message}
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func errorPayload(err error) ErrorPayload {
+	var ee *ProtocolError
+	if errors.As(err, &ee) {
+		return ErrorPayload{Code: ee.Code, Message: ee.Message}
+	}
+	return ErrorPayload{Code: ErrCodeRejected, Message: err.Error()}
+}
+
+// Payloads
+
+type MessageSendPayload struct {
+	ChatID        uint   `json:"chat_id"`
+	ReceiverID    *uint  `json:"receiver_id,omitempty"`
+	Content       string `json:"content"`
+	ReplyToID     *uint  `json:"reply_to_id,omitempty"`
+	AttachmentIDs []uint `json:"attachment_ids,omitempty"`
+}
+
+type MessageAckPayload struct {
+	MessageID uint      `json:"message_id"`
+	ChatID    uint      `json:"chat_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeliveryAckPayload is what clients send with message.ack.
+type DeliveryAckPayload struct {
+	MessageIDs []uint `json:"message_ids"`
+}
+
+// MessageStatusPayload tells a sender how far a message got for one recipient.
+type MessageStatusPayload struct {
+	MessageID uint      `json:"message_id"`
+	ChatID    uint      `json:"chat_id"`
+	UserID    uint      `json:"user_id"`
+	Status    string    `json:"status"`
+	At        time.Time `json:"at"`
+}
+
+// ReadPayload moves the sender's read marker (client -> server) and is
+// relayed to the chat's other members as a read receipt.
+type ReadPayload struct {
+	ChatID    uint `json:"chat_id"`
+	UserID    uint `json:"user_id,omitempty"`
+	MessageID uint `json:"message_id"`
+}
+
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+
+	TypingStart = "start"
+	TypingStop  = "stop"
+)
+
+type PresencePayload struct {
+	UserID   uint       `json:"user_id"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+type TypingPayload struct {
+	ChatID uint   `json:"chat_id"`
+	UserID uint   `json:"user_id,omitempty"`
+	State  string `json:"state"`
+}
+
+type MessageEditPayload struct {
+	MessageID uint   `json:"message_id"`
+	Content   string `json:"content"`
+}
+
+type MessageDeletePayload struct {
+	MessageID uint   `json:"message_id"`
+	ChatID    uint   `json:"chat_id,omitempty"`
+	Scope     string `json:"scope"`
+}
+
+type ReactionPayload struct {
+	MessageID uint   `json:"message_id"`
+	ChatID    uint   `json:"chat_id,omitempty"`
+	UserID    uint   `json:"user_id,omitempty"`
+	Emoji     string `json:"emoji"`
+}
+
+// HandlerFunc handles one event type received from a client.
+type HandlerFunc func(c *Client, e *Envelope) error
@@ -0,0 +1,89 @@
+package httpserver
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/SourishBeast7/Glooo/media"
+	"github.com/gorilla/mux"
+)
+
+const (
+	pfpFolder        = "pfp"
+	attachmentFolder = "attachments"
+)
+
+// publicMediaFolders are served to anyone; everything else needs its own
+// authorised download route.
+var publicMediaFolders = []string{pfpFolder + "/"}
+
+func (s *Server) handleMediaRoutes(router *mux.Router) {
+	router.PathPrefix("/").Handler(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		key := strings.TrimPrefix(r.URL.Path, "/media/")
+		if !isPublicMedia(key) {
+			http.NotFound(w, r)
+			return nil
+		}
+		return s.serveMedia(w, r, key, "")
+	})).Methods(http.MethodGet)
+}
+
+func (s *Server) handleAttachmentRoutes(router *mux.Router) {
+	router.HandleFunc("/{id}", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		attachment, err := s.store.GetAttachment(p.UserID, id)
+		if err != nil {
+			http.NotFound(w, r)
+			return nil
+		}
+		return s.serveMedia(w, r, attachment.StorageKey, attachment.FileName)
+	}))).Methods(http.MethodGet)
+}
+
+func isPublicMedia(key string) bool {
+	if !media.ValidKey(key) {
+		return false
+	}
+	for _, folder := range publicMediaFolders {
+		if strings.HasPrefix(key, folder) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveMedia streams key from the media store. A non-empty filename is sent
+// as an attachment disposition.
+func (s *Server) serveMedia(w http.ResponseWriter, r *http.Request, key string, filename string) error {
+	body, contentType, err := s.media.Store.Open(r.Context(), key)
+	if errors.Is(err, media.ErrNotFound) || errors.Is(err, media.ErrInvalidKey) {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("media: streaming %s: %v", key, err)
+	}
+	return nil
+}
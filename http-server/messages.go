@@ -0,0 +1,137 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"github.com/SourishBeast7/Glooo/http-server/hub"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/gorilla/mux"
+)
+
+// Message edits, deletes and reactions
+
+func (s *Server) handleMessageRoutes(router *mux.Router) {
+	router.HandleFunc("/{id}", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		messageID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		content, err := hub.ValidateContent(body.Content)
+		if err != nil {
+			return err
+		}
+		message, err := s.store.EditMessage(p.UserID, messageID, content)
+		if err != nil {
+			return err
+		}
+		s.hub.PublishMessageEdited(message, nil)
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+			"message": message,
+		})
+	}))).Methods(http.MethodPatch)
+
+	router.HandleFunc("/{id}", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		messageID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		scope := r.URL.Query().Get("scope")
+		var message *models.Message
+		switch scope {
+		case models.DeleteForMe:
+			message, err = s.store.DeleteMessageForMe(p.UserID, messageID)
+		case models.DeleteForEveryone:
+			message, err = s.store.DeleteMessageForEveryone(p.UserID, messageID)
+		default:
+			return errors.New("scope must be me or everyone")
+		}
+		if err != nil {
+			return err
+		}
+		s.hub.PublishMessageDeleted(message, scope, p.UserID, nil)
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodDelete)
+
+	router.HandleFunc("/{id}/history", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		messageID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		edits, err := s.store.GetMessageEdits(p.UserID, messageID)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"edits": edits,
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/{id}/reactions", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		messageID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Emoji string `json:"emoji"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		message, err := s.store.AddReaction(p.UserID, messageID, body.Emoji)
+		if err != nil {
+			return err
+		}
+		s.hub.PublishReaction(message, p.UserID, body.Emoji, true)
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/{id}/reactions", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		messageID, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		emoji := r.URL.Query().Get("emoji")
+		message, err := s.store.RemoveReaction(p.UserID, messageID, emoji)
+		if err != nil {
+			return err
+		}
+		s.hub.PublishReaction(message, p.UserID, emoji, false)
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodDelete)
+}
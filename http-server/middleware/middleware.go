@@ -1,16 +1,87 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func AuthMiddleWare(f http.HandlerFunc) http.HandlerFunc {
+type Claims struct {
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	Pfp       string    `json:"pfp"`
+	CreatedAt time.Time `json:"createdAt"`
+	Family    string    `json:"fam"`
+	Verified  bool      `json:"ev"`
+	jwt.RegisteredClaims
+}
+
+// Principal is the authenticated user a request acts on behalf of.
+type Principal struct {
+	UserID uint
+	Email  string
+	// Session is the refresh token family the access token was issued for.
+	Session string
+	// Verified is whether the user had confirmed their email address when
+	// the access token was issued.
+	Verified bool
+}
+
+// SessionStore tells the middleware whether a login session has been revoked.
+type SessionStore interface {
+	IsTokenFamilyActive(family string) bool
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+func ParseToken(tokenStr string) (*Claims, error) {
+	claims := new(Claims)
+	token, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (any, error) {
+		if m, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unrecognized signing method : %v", m)
+		}
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	}, jwt.WithExpirationRequired(), jwt.WithIssuedAt())
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+func principalFromClaims(claims *Claims) (*Principal, error) {
+	id, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil || id == 0 {
+		return nil, errors.New("token has no valid subject")
+	}
+	return &Principal{
+		UserID:   uint(id),
+		Email:    claims.Email,
+		Session:  claims.Family,
+		Verified: claims.Verified,
+	}, nil
+}
+
+func AuthMiddleWare(sessions SessionStore, f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cookie, err := r.Cookie("token")
 		if err != nil {
@@ -19,20 +90,45 @@ func AuthMiddleWare(f http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		tokenStr := strings.Split(cookie.Value, " ")[1]
-		token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (any, error) {
-			if m, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				log.Println(ok)
-				return nil, fmt.Errorf("unrecognized signing method : %v", m)
-			}
-			return []byte(os.Getenv("JWT_SECRET")), nil
-		})
-		if err != nil || !token.Valid {
+		tokenStr, ok := strings.CutPrefix(cookie.Value, "Bearer ")
+		if !ok {
+			http.Error(w, "Invalid Token String", http.StatusUnauthorized)
+			return
+		}
+		claims, err := ParseToken(tokenStr)
+		if err != nil {
+			log.Printf("%+v", err.Error())
+			http.Error(w, "Unauthorized - Invalid Token", http.StatusUnauthorized)
+			return
+		}
+		principal, err := principalFromClaims(claims)
+		if err != nil {
 			log.Printf("%+v", err.Error())
 			http.Error(w, "Unauthorized - Invalid Token", http.StatusUnauthorized)
 			return
 		}
+		if principal.Session == "" || !sessions.IsTokenFamilyActive(principal.Session) {
+			http.Error(w, "Unauthorized - Session Revoked", http.StatusUnauthorized)
+			return
+		}
 		log.Println("Authentication Done...")
+		f(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	}
+}
+
+// RequireVerified limits f to users who have confirmed their email address.
+// It must be wrapped by AuthMiddleWare.
+func RequireVerified(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := PrincipalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !p.Verified {
+			http.Error(w, "Forbidden - Email Not Verified", http.StatusForbidden)
+			return
+		}
 		f(w, r)
 	}
 }
@@ -0,0 +1,151 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/SourishBeast7/Glooo/notifications"
+	"github.com/gorilla/mux"
+)
+
+// notify puts n in its owner's inbox and sends it on over their other channels.
+func (s *Server) notify(n *models.Notification) {
+	if err := s.notifier.Notify(context.Background(), n); err != nil {
+		log.Printf("notification: %v", err)
+	}
+}
+
+// notifyFriendRequest tells the other side of req about its current status.
+func (s *Server) notifyFriendRequest(req *models.FriendRequest) {
+	n := &models.Notification{RequestID: &req.ID}
+	switch req.Status {
+	case models.RequestPending:
+		n.Type, n.UserID, n.ActorID = models.NotifyFriendRequest, req.ToID, &req.FromID
+	case models.RequestAccepted:
+		n.Type, n.UserID, n.ActorID = models.NotifyRequestAccepted, req.FromID, &req.ToID
+	case models.RequestRejected:
+		n.Type, n.UserID, n.ActorID = models.NotifyRequestDeclined, req.FromID, &req.ToID
+	case models.RequestCancelled:
+		n.Type, n.UserID, n.ActorID = models.NotifyRequestCanceled, req.ToID, &req.FromID
+	default:
+		return
+	}
+	s.notify(n)
+}
+
+// Notifications inbox
+
+func (s *Server) handleNotificationRoutes(router *mux.Router) {
+	router.HandleFunc("", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		query := r.URL.Query()
+		var before uint
+		var limit int
+		if v := query.Get("before"); v != "" {
+			before = StringToUint(v)
+		}
+		if v := query.Get("limit"); v != "" {
+			limit = int(StringToUint(v))
+		}
+		notifications, err := s.store.GetNotifications(p.UserID, query.Get("unread") == "true", before, limit)
+		if err != nil {
+			return err
+		}
+		unread, err := s.store.UnreadNotificationCount(p.UserID)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"notifications": notifications,
+			"unread":        unread,
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/settings", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		settings, err := s.store.GetNotificationSettings(p.UserID)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"settings": settings,
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/settings", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		// Start from the stored settings so a partial body only changes
+		// the fields it names.
+		settings, err := s.store.GetNotificationSettings(p.UserID)
+		if err != nil {
+			return err
+		}
+		previousURL := settings.WebhookURL
+		if err := json.NewDecoder(r.Body).Decode(settings); err != nil {
+			return err
+		}
+		settings.UserID = p.UserID
+		if err := notifications.ValidateSettings(settings); err != nil {
+			return err
+		}
+		// A new URL gets a new secret, so a secret handed to one endpoint
+		// never signs deliveries to another.
+		res := Response{"settings": settings}
+		if settings.WebhookURL != previousURL {
+			settings.WebhookSecret = ""
+			if settings.WebhookURL != "" {
+				settings.WebhookSecret = notifications.NewWebhookSecret()
+				res["webhook_secret"] = settings.WebhookSecret
+			}
+		}
+		if err := s.store.SaveNotificationSettings(settings); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, res)
+	}))).Methods(http.MethodPut)
+
+	router.HandleFunc("/read", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		marked, err := s.store.MarkAllNotificationsRead(p.UserID)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+			"marked":  marked,
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/{id}/read", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		if err := s.store.MarkNotificationRead(p.UserID, id); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+}
@@ -0,0 +1,204 @@
+package httpserver
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"github.com/SourishBeast7/Glooo/oidc"
+	"github.com/gorilla/mux"
+)
+
+const (
+	oauthStateCookie = "oauth_state"
+	oauthStateTTL    = 10 * time.Minute
+)
+
+// oauthState is what the browser carries from the start of a sign in to the
+// callback, signed so it cannot be tampered with.
+type oauthState struct {
+	Provider string `json:"p"`
+	State    string `json:"s"`
+	Verifier string `json:"v"`
+	Nonce    string `json:"n"`
+	Redirect string `json:"r"`
+	Expires  int64  `json:"e"`
+}
+
+func setOAuthState(w http.ResponseWriter, st *oauthState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	body := base64.RawURLEncoding.EncodeToString(data)
+	secMode, _ := cookieModes()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    body + "." + signToken(oauthStateCookie, body),
+		HttpOnly: true,
+		Path:     "/auth/oauth",
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		// Lax, so the cookie comes along on the provider's redirect back.
+		SameSite: http.SameSiteLaxMode,
+		Secure:   secMode,
+	})
+	return nil
+}
+
+func readOAuthState(r *http.Request) (*oauthState, error) {
+	invalid := errors.New("sign in session expired, please try again")
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil {
+		return nil, invalid
+	}
+	body, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signToken(oauthStateCookie, body))) {
+		return nil, invalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, invalid
+	}
+	st := new(oauthState)
+	if err := json.Unmarshal(data, st); err != nil || time.Now().Unix() > st.Expires {
+		return nil, invalid
+	}
+	return st, nil
+}
+
+func clearOAuthState(w http.ResponseWriter) {
+	secMode, _ := cookieModes()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    "",
+		HttpOnly: true,
+		Path:     "/auth/oauth",
+		MaxAge:   -1,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   secMode,
+	})
+}
+
+// localRedirect keeps post login redirects inside the frontend.
+func localRedirect(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+func (s *Server) provider(r *http.Request) (*oidc.Provider, error) {
+	p, ok := s.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		return nil, oidc.ErrUnknownProvider
+	}
+	return p, nil
+}
+
+// Social login
+
+func (s *Server) handleOAuthRoutes(router *mux.Router) {
+	router.HandleFunc("/providers", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		names := make([]string, 0, len(s.providers))
+		for name := range s.providers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return WriteJson(w, http.StatusOK, Response{
+			"providers": names,
+		})
+	})).Methods(http.MethodGet)
+
+	router.HandleFunc("/{provider}/start", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := s.provider(r)
+		if err != nil {
+			return err
+		}
+		st := &oauthState{
+			Provider: p.Name(),
+			State:    oidc.NewVerifier(),
+			Verifier: oidc.NewVerifier(),
+			Nonce:    oidc.NewVerifier(),
+			Redirect: localRedirect(r.URL.Query().Get("redirect")),
+			Expires:  time.Now().Add(oauthStateTTL).Unix(),
+		}
+		target, err := p.AuthCodeURL(r.Context(), st.State, st.Verifier, st.Nonce)
+		if err != nil {
+			return err
+		}
+		if err := setOAuthState(w, st); err != nil {
+			return err
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+		return nil
+	})).Methods(http.MethodGet)
+
+	router.HandleFunc("/{provider}/callback", func(w http.ResponseWriter, r *http.Request) {
+		// Whatever happens, the user ends up back in the frontend.
+		fail := func(err error) {
+			log.Printf("oauth: %v", err)
+			http.Redirect(w, r, appURL("/login", url.Values{"error": {err.Error()}}), http.StatusFound)
+		}
+		st, err := readOAuthState(r)
+		clearOAuthState(w)
+		if err != nil {
+			fail(err)
+			return
+		}
+		p, err := s.provider(r)
+		if err != nil {
+			fail(err)
+			return
+		}
+		query := r.URL.Query()
+		if e := query.Get("error"); e != "" {
+			fail(errors.New("sign in was cancelled: " + e))
+			return
+		}
+		if st.Provider != p.Name() || !hmac.Equal([]byte(query.Get("state")), []byte(st.State)) {
+			fail(errors.New("sign in state does not match, please try again"))
+			return
+		}
+		tok, err := p.Exchange(r.Context(), query.Get("code"), st.Verifier)
+		if err != nil {
+			fail(err)
+			return
+		}
+		identity, err := p.Identity(r.Context(), tok, st.Nonce)
+		if err != nil {
+			fail(err)
+			return
+		}
+		user, err := s.store.SignInWithIdentity(&models.ExternalLogin{
+			Provider:      identity.Provider,
+			Subject:       identity.Subject,
+			Email:         identity.Email,
+			EmailVerified: identity.EmailVerified,
+			Name:          identity.Name,
+			Picture:       identity.Picture,
+		})
+		if err != nil {
+			fail(err)
+			return
+		}
+		challenge, err := s.beginLogin(w, user)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if challenge != "" {
+			setChallengeCookie(w, challenge)
+			http.Redirect(w, r, appURL("/login/2fa", url.Values{"redirect": {st.Redirect}}), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, appURL(st.Redirect, nil), http.StatusFound)
+	}).Methods(http.MethodGet)
+}
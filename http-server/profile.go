@@ -0,0 +1,188 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/gorilla/mux"
+)
+
+// Own profile and privacy settings
+
+func (s *Server) handleProfileRoutes(router *mux.Router) {
+	s.handleTwoFactorRoutes(router.PathPrefix("/2fa").Subrouter())
+
+	router.HandleFunc("", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		user, err := s.store.FindUserById(p.UserID)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"user": user,
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		update := new(models.ProfileUpdate)
+		if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+			return err
+		}
+		user, err := s.store.UpdateProfile(p.UserID, update)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"user": user,
+		})
+	}))).Methods(http.MethodPatch)
+
+	router.HandleFunc("/pfp", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		file, header, err := r.FormFile("pfp")
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		obj, err := s.uploadFilesToCdn(r.Context(), file, pfpFolder, header.Filename, "image/")
+		if err != nil {
+			return err
+		}
+		user, err := s.store.UpdateProfile(p.UserID, &models.ProfileUpdate{Pfp: &obj.URL})
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"user": user,
+		})
+	}))).Methods(http.MethodPut)
+
+	router.HandleFunc("/password", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		var body struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		// Other devices are signed out; this one keeps its session.
+		if err := s.store.ChangePassword(p.UserID, body.CurrentPassword, body.NewPassword, p.Session); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPut)
+
+	router.HandleFunc("/email", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		user, email, err := s.store.PrepareEmailChange(p.UserID, body.Password, body.Email)
+		if err != nil {
+			return err
+		}
+		if err := s.sendEmailChange(r.Context(), user, email); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+			"message": "Check your new inbox to confirm the change",
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/username", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		username, err := s.store.SetUsername(p.UserID, body.Username)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success":  true,
+			"username": username,
+		})
+	}))).Methods(http.MethodPut)
+
+	router.HandleFunc("/discoverability", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Discoverability string `json:"discoverability"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		if err := s.store.SetDiscoverability(p.UserID, body.Discoverability); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPut)
+
+	router.HandleFunc("/identities", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		identities, err := s.store.GetIdentities(p.UserID)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"identities": identities,
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/identities/{id}", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		if err := s.store.UnlinkIdentity(p.UserID, id); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodDelete)
+}
@@ -0,0 +1,64 @@
+package httpserver
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/gorilla/mux"
+)
+
+// parseTimeParam accepts RFC 3339 timestamps or plain dates (YYYY-MM-DD).
+func parseTimeParam(name string, v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid %s: use RFC 3339 or YYYY-MM-DD", name)
+}
+
+// Search
+
+func (s *Server) handleSearchRoutes(router *mux.Router) {
+	router.HandleFunc("/messages", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		query := r.URL.Query()
+		q := &models.MessageSearch{
+			Query: query.Get("q"),
+		}
+		if v := query.Get("chat_id"); v != "" {
+			q.ChatID = StringToUint(v)
+		}
+		if v := query.Get("sender_id"); v != "" {
+			q.SenderID = StringToUint(v)
+		}
+		if v := query.Get("limit"); v != "" {
+			q.Limit = int(StringToUint(v))
+		}
+		if v := query.Get("offset"); v != "" {
+			q.Offset = int(StringToUint(v))
+		}
+		if q.From, err = parseTimeParam("from", query.Get("from")); err != nil {
+			return err
+		}
+		if q.To, err = parseTimeParam("to", query.Get("to")); err != nil {
+			return err
+		}
+		hits, err := s.store.SearchMessages(p.UserID, q)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"results": hits,
+		})
+	}))).Methods(http.MethodGet)
+}
@@ -1,19 +1,23 @@
 package httpserver
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/SourishBeast7/Glooo/db"
 	"github.com/SourishBeast7/Glooo/db/models"
 	"github.com/SourishBeast7/Glooo/http-server/hub"
 	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/SourishBeast7/Glooo/media"
+	"github.com/SourishBeast7/Glooo/notifications"
+	"github.com/SourishBeast7/Glooo/oidc"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -24,6 +28,10 @@ type Server struct {
 	listenAddr string
 	store      *db.Storage
 	hub        *hub.Hub
+	media      *media.Uploader
+	notifier   *notifications.Dispatcher
+	mail       notifications.MailSender
+	providers  map[string]*oidc.Provider
 }
 
 type handlerFunc func(w http.ResponseWriter, r *http.Request) error
@@ -38,11 +46,55 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// mailSender returns the SMTP mailer. Only in development may it fall back
+// to logging mail, since the log would otherwise hold live token links.
+func mailSender() (notifications.MailSender, error) {
+	mailer, err := notifications.MailerFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if mailer != nil {
+		return mailer, nil
+	}
+	if os.Getenv("ENVIRONMENT") != "dev" {
+		return nil, errors.New("SMTP_ADDR is required outside ENVIRONMENT=dev")
+	}
+	log.Println("📧 SMTP_ADDR not set, mail will be written to the log")
+	return notifications.LogMailer{}, nil
+}
+
 func NewServer(addr string) *Server {
+	uploader, err := media.NewFromEnv()
+	if err != nil {
+		log.Fatalf("media: %v", err)
+	}
+	bus, err := hub.NewBusFromEnv(context.Background())
+	if err != nil {
+		log.Fatalf("hub bus: %v", err)
+	}
+	store := db.NewStorage()
+	h := hub.NewHub(bus)
+	notifier, err := notifications.NewFromEnv(store, h)
+	if err != nil {
+		log.Fatalf("notifications: %v", err)
+	}
+	h.SetMessageListener(notifier)
+	mail, err := mailSender()
+	if err != nil {
+		log.Fatalf("mail: %v", err)
+	}
+	providers, err := oidc.ProvidersFromEnv()
+	if err != nil {
+		log.Fatalf("oidc: %v", err)
+	}
 	return &Server{
 		listenAddr: addr,
-		store:      db.NewStorage(),
-		hub:        hub.NewHub(),
+		store:      store,
+		hub:        h,
+		media:      uploader,
+		notifier:   notifier,
+		mail:       mail,
+		providers:  providers,
 	}
 }
 
@@ -55,6 +107,15 @@ func StringToUint(s string) uint {
 	return uint(i)
 }
 
+// principal returns the user the request was authenticated as by AuthMiddleWare.
+func principal(r *http.Request) (*m.Principal, error) {
+	p, ok := m.PrincipalFromContext(r.Context())
+	if !ok {
+		return nil, errors.New("unauthenticated request")
+	}
+	return p, nil
+}
+
 func makeHttpHandler(f handlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
@@ -70,16 +131,27 @@ func WriteJson(w http.ResponseWriter, status int, v map[string]any) error {
 	return json.NewEncoder(w).Encode(v)
 }
 
-func uploadFilesToCdn(_ io.Reader, _ string, _ string) (string, error) {
-	return "", nil
+// uploadFilesToCdn stores file in the configured media backend under folder.
+// The content type is sniffed from the data and must match one of allowed.
+func (s *Server) uploadFilesToCdn(ctx context.Context, file io.Reader, folder string, filename string, allowed ...string) (*media.Object, error) {
+	return s.media.Save(ctx, file, folder, filename, allowed...)
 }
 
-func GenerateJWT(user *models.User) (string, error) {
-	claims := jwt.MapClaims{
-		"email":     user.Email,
-		"name":      user.Name,
-		"pfp":       user.Pfp,
-		"createdAt": user.CreatedAt,
+func GenerateJWT(user *models.User, family string) (string, error) {
+	now := time.Now()
+	claims := m.Claims{
+		Email:     user.Email,
+		Name:      user.Name,
+		Pfp:       user.Pfp,
+		CreatedAt: user.CreatedAt,
+		Family:    family,
+		Verified:  user.EmailVerifiedAt != nil,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			ID:        randomToken(16),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+		},
 	}
 	jwtSecret := []byte(os.Getenv("JWT_SECRET"))
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -95,6 +167,7 @@ func (s *Server) HandleRoutes() {
 	router := mux.NewRouter()
 	s.store.Init()
 	go s.hub.Run(s.store)
+	go s.notifier.Run(context.Background())
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:5173", "http:localhost:5173/*"},
 		AllowCredentials: true,
@@ -109,6 +182,7 @@ func (s *Server) HandleRoutes() {
 	s.handleApiRoutes(router.PathPrefix("/api").Subrouter())
 	s.handleFriendsRoute(router.PathPrefix("/user").Subrouter())
 	s.handleTestingRoutes(router.PathPrefix("/test").Subrouter())
+	s.handleMediaRoutes(router.PathPrefix("/media").Subrouter())
 
 	router.HandleFunc("/", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
 		return WriteJson(w, http.StatusOK, Response{
@@ -130,16 +204,21 @@ func (s *Server) handleAuthRoutes(router *mux.Router) {
 		user.Name = r.FormValue("name")
 		user.Email = r.FormValue("email")
 		user.Password = r.FormValue("password")
+		if username := r.FormValue("username"); username != "" {
+			user.Username = &username
+		}
 		file, header, err := r.FormFile("pfp")
-		if err != nil {
+		if err != nil && !errors.Is(err, http.ErrMissingFile) {
 			return err
 		}
-		defer file.Close()
-		pfp, err := uploadFilesToCdn(file, user.Email, header.Filename)
-		if err != nil {
-			return err
+		if file != nil {
+			defer file.Close()
+			pfp, err := s.uploadFilesToCdn(r.Context(), file, pfpFolder, header.Filename, "image/")
+			if err != nil {
+				return err
+			}
+			user.Pfp = pfp.URL
 		}
-		user.Pfp = pfp
 		err = s.store.CreateUser(user)
 		if err != nil {
 			WriteJson(w, http.StatusNotAcceptable, Response{
@@ -147,6 +226,11 @@ func (s *Server) handleAuthRoutes(router *mux.Router) {
 			})
 			return err
 		}
+		go func() {
+			if err := s.sendVerificationEmail(context.Background(), user); err != nil {
+				log.Printf("verification email: %v", err)
+			}
+		}()
 		return WriteJson(w, http.StatusOK, Response{
 			"success": "true",
 			"message": "User created Successfully",
@@ -164,71 +248,100 @@ func (s *Server) handleAuthRoutes(router *mux.Router) {
 		if err != nil {
 			return err
 		}
-		token, err := GenerateJWT(user)
+		challenge, err := s.beginLogin(w, user)
 		if err != nil {
 			WriteJson(w, http.StatusNotAcceptable, Response{
 				"success": false,
 			})
 			return err
 		}
-		var secMode bool
-		var siteMode http.SameSite
-		env := os.Getenv("ENVIRONMENT")
-		if env == "dev" {
-			secMode = false
-			siteMode = http.SameSiteLaxMode
-		} else {
-			secMode = true
-			siteMode = http.SameSiteNoneMode
-		}
-		id := strconv.Itoa(int(user.ID))
-		finalToken := fmt.Sprintf("Bearer %s", token)
-		http.SetCookie(w, &http.Cookie{
-			Name:     "token",
-			Value:    finalToken,
-			HttpOnly: true,
-			Path:     "/",
-			SameSite: siteMode,
-			Secure:   secMode, // Set to true in production with HTTPS
+		if challenge != "" {
+			return WriteJson(w, http.StatusOK, Response{
+				"success":             true,
+				"two_factor_required": true,
+				"challenge":           challenge,
+			})
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
 		})
-		http.SetCookie(w, &http.Cookie{
-			Name:     "id",
-			Value:    id,
-			HttpOnly: true,
-			Path:     "/",
-			SameSite: siteMode,
-			Secure:   secMode, // Set to true in production with HTTPS
+	})).Methods(http.MethodPost)
+
+	router.HandleFunc("/refresh", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		cookie, err := r.Cookie(refreshCookieName)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"success": false,
+			})
+		}
+		if err := s.refreshSession(w, cookie.Value); err != nil {
+			clearSessionCookies(w)
+			log.Printf("%v", err)
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"success": false,
+				"message": err.Error(),
+			})
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
 		})
+	})).Methods(http.MethodPost)
+
+	router.HandleFunc("/logout", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		s.endSession(r)
+		clearSessionCookies(w)
 		return WriteJson(w, http.StatusOK, Response{
 			"success": true,
 		})
 	})).Methods(http.MethodPost)
+
+	s.handleTwoFactorLogin(router)
+	s.handleVerificationRoutes(router)
+	s.handleOAuthRoutes(router.PathPrefix("/oauth").Subrouter())
 }
 
 // Get Friends , Messages And Chats
 
 func (s *Server) handleApiRoutes(router *mux.Router) {
-
-	router.HandleFunc("/search-user/{email}", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
-		email := mux.Vars(r)["email"]
-		cookie, err := r.Cookie("id")
-		id := StringToUint(cookie.Value)
-		users, err := s.store.FindUsersUsingSubstring(id, email)
+	s.handleGroupRoutes(router.PathPrefix("/groups").Subrouter())
+	s.handleChatApiRoutes(router.PathPrefix("/chats").Subrouter())
+	s.handleMessageRoutes(router.PathPrefix("/messages").Subrouter())
+	s.handleAttachmentRoutes(router.PathPrefix("/attachments").Subrouter())
+	s.handleSearchRoutes(router.PathPrefix("/search").Subrouter())
+	s.handleProfileRoutes(router.PathPrefix("/me").Subrouter())
+	s.handleNotificationRoutes(router.PathPrefix("/notifications").Subrouter())
+
+	router.HandleFunc("/search-user/{query}", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		term := mux.Vars(r)["query"]
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		query := r.URL.Query()
+		var page, limit int
+		if v := query.Get("page"); v != "" {
+			page = int(StringToUint(v))
+		}
+		if v := query.Get("limit"); v != "" {
+			limit = int(StringToUint(v))
+		}
+		users, more, err := s.store.SearchUsers(p.UserID, term, page, limit)
 		if err != nil {
 			return err
 		}
 		return WriteJson(w, http.StatusOK, Response{
-			"users": users,
+			"users":    users,
+			"page":     max(page, 1),
+			"has_more": more,
 		})
 	})))
 
-	router.HandleFunc("/getfriends", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
-		cookie, err := r.Cookie("id")
+	router.HandleFunc("/getfriends", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
 		if err != nil {
 			return err
 		}
-		user_id := StringToUint(cookie.Value)
-		friends, err := s.store.GetFriends(user_id)
+		friends, err := s.store.GetFriends(p.UserID)
 		if err != nil {
 			return err
 		}
@@ -237,19 +350,12 @@ func (s *Server) handleApiRoutes(router *mux.Router) {
 		})
 	})))
 
-	router.HandleFunc("/getchats", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
-		cookie, err := r.Cookie("id")
+	router.HandleFunc("/getchats", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
 		if err != nil {
-			WriteJson(w, http.StatusNotAcceptable, Response{
-				"err": err,
-			})
 			return err
 		}
-		uid := StringToUint(cookie.Value)
-		if uid == 0 {
-			return errors.New("invalid user id")
-		}
-		chats, err := s.store.GetChatsByUserId(uid)
+		chats, err := s.store.GetChatsByUserId(p.UserID)
 		if err != nil {
 			return err
 		}
@@ -258,22 +364,42 @@ func (s *Server) handleApiRoutes(router *mux.Router) {
 		})
 	}))).Methods(http.MethodGet)
 
-	router.HandleFunc("/getmessages", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
-		chat_id := r.URL.Query().Get("chat_id")
-		id := StringToUint(chat_id)
-		if id == 0 {
+	router.HandleFunc("/getmessages", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		query := r.URL.Query()
+		q := &models.MessageQuery{
+			ChatID: StringToUint(query.Get("chat_id")),
+		}
+		if q.ChatID == 0 {
 			return errors.New("invalid request")
 		}
-		messages, err := s.store.GetMessages(id)
+		if v := query.Get("before"); v != "" {
+			q.Before = StringToUint(v)
+		}
+		if v := query.Get("after"); v != "" {
+			q.After = StringToUint(v)
+		}
+		if v := query.Get("limit"); v != "" {
+			q.Limit = int(StringToUint(v))
+		}
+		messages, next, err := s.store.GetMessages(p.UserID, q)
 		if err != nil {
 			WriteJson(w, http.StatusNotAcceptable, Response{
 				"success": false,
 			})
 			return err
 		}
+		var cursor any
+		if next != 0 {
+			cursor = next
+		}
 		return WriteJson(w, http.StatusOK, Response{
-			"success":  true,
-			"messages": messages,
+			"success":     true,
+			"messages":    messages,
+			"next_cursor": cursor,
 		})
 	}))).Methods(http.MethodGet)
 
@@ -282,13 +408,12 @@ func (s *Server) handleApiRoutes(router *mux.Router) {
 //Find Friends and Friend Requests Route
 
 func (s *Server) handleFriendsRoute(router *mux.Router) {
-	router.HandleFunc("/friend_requests", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
-		cookie, err := r.Cookie("id")
+	router.HandleFunc("/friend_requests", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
 		if err != nil {
 			return err
 		}
-		uid := StringToUint(cookie.Value)
-		friendRequests, err := s.store.GetReceivedFriendRequest(uid)
+		friendRequests, err := s.store.GetReceivedFriendRequest(p.UserID)
 		if err != nil {
 			return err
 		}
@@ -297,33 +422,162 @@ func (s *Server) handleFriendsRoute(router *mux.Router) {
 		})
 	}))).Methods(http.MethodGet)
 
-	router.HandleFunc("/send_request/{email}", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
-		cookie, err := r.Cookie("id")
+	router.HandleFunc("/send_request/{email}", m.AuthMiddleWare(s.store, m.RequireVerified(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
 		if err != nil {
 			return err
 		}
 		email := mux.Vars(r)["email"]
-		id := StringToUint(cookie.Value)
-		if err := s.store.SendFriendRequest(id, email); err != nil {
+		req, err := s.store.SendFriendRequest(p.UserID, email)
+		if err != nil {
 			return err
 		}
+		s.notifyFriendRequest(req)
 		return WriteJson(w, http.StatusOK, Response{
 			"success": true,
 		})
-	})))
+	}))))
 
-	router.HandleFunc("/handle_request", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+	router.HandleFunc("/handle_request", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
 		req := new(models.HandleRequest)
 		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
 			return err
 		}
-		if err := s.store.HandleFriendRequest(req); err != nil {
+		// Only the recipient of a request can act on it.
+		req.ToID = p.UserID
+		answered, err := s.store.HandleFriendRequest(req)
+		if err != nil {
 			return err
 		}
+		s.notifyFriendRequest(answered)
 		return WriteJson(w, http.StatusOK, Response{
 			"success": "",
 		})
 	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/sent_requests", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		requests, err := s.store.GetSentFriendRequests(p.UserID)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"requests": requests,
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/sent_requests/{id}", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		cancelled, err := s.store.CancelFriendRequest(p.UserID, id)
+		if err != nil {
+			return err
+		}
+		s.notifyFriendRequest(cancelled)
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodDelete)
+
+	// Sending by id is how users found through search, which never shows an
+	// email address, are added.
+	router.HandleFunc("/friends/{id}", m.AuthMiddleWare(s.store, m.RequireVerified(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		req, err := s.store.SendFriendRequestTo(p.UserID, id)
+		if err != nil {
+			return err
+		}
+		s.notifyFriendRequest(req)
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+			"request": req,
+		})
+	})))).Methods(http.MethodPost)
+
+	router.HandleFunc("/friends/{id}", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		if err := s.store.Unfriend(p.UserID, id); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodDelete)
+
+	router.HandleFunc("/blocked", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		users, err := s.store.GetBlockedUsers(p.UserID)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"users": users,
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/block/{id}", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		if err := s.store.BlockUser(p.UserID, id); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/block/{id}", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		id, err := pathID(r, "id")
+		if err != nil {
+			return err
+		}
+		if err := s.store.UnblockUser(p.UserID, id); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodDelete)
 }
 
 //Find Friends and Friend Requests Route - end
@@ -332,11 +586,15 @@ func (s *Server) handleFriendsRoute(router *mux.Router) {
 
 func (s *Server) handleChatRoutes(router *mux.Router) {
 	// Websocket Route
-	router.HandleFunc("/", m.AuthMiddleWare(makeHttpHandler(s.wsConnHandler))).Methods(http.MethodGet)
+	router.HandleFunc("/", m.AuthMiddleWare(s.store, makeHttpHandler(s.wsConnHandler))).Methods(http.MethodGet)
 }
 
 func (s *Server) wsConnHandler(w http.ResponseWriter, r *http.Request) error {
 	log.Println("➡️ Incoming WebSocket request...")
+	p, err := principal(r)
+	if err != nil {
+		return err
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("❌ WebSocket upgrade failed:", err)
@@ -344,12 +602,10 @@ func (s *Server) wsConnHandler(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	log.Println("✅ WebSocket connection upgraded")
-	cookie, err := r.Cookie("id")
-	if err != nil {
-		return err
-	}
-	client := s.hub.NewClient(StringToUint(cookie.Value), conn)
+	client := s.hub.NewClient(p.UserID, conn)
+	client.Verified = p.Verified
 	s.hub.Register <- client
+	go client.WritePump()
 	go s.hub.Readloop(client)
 	return nil
 }
@@ -357,16 +613,16 @@ func (s *Server) wsConnHandler(w http.ResponseWriter, r *http.Request) error {
 //Testing Routes Start
 
 func (s *Server) handleTestingRoutes(router *mux.Router) {
-	// router.HandleFunc("/create", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+	// router.HandleFunc("/create", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
 	// 	var data map[string]string
 	// 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 	// 		return err
 	// 	}
-	// 	cookie, err := r.Cookie("id")
+	// 	p, err := principal(r)
 	// 	if err != nil {
 	// 		return err
 	// 	}
-	// 	user1, err := s.store.FindUserById(StringToUint(cookie.Value))
+	// 	user1, err := s.store.FindUserById(p.UserID)
 	// 	if err != nil {
 	// 		return err
 	// 	}
@@ -379,7 +635,7 @@ func (s *Server) handleTestingRoutes(router *mux.Router) {
 	// 		"msg": "Chat Created",
 	// 	})
 	// }))).Methods(http.MethodPost)
-	router.HandleFunc("/t1", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+	router.HandleFunc("/t1", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
 		return WriteJson(w, http.StatusOK, Response{
 			"message": "Destination Reached",
 		})
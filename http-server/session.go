@@ -0,0 +1,136 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+
+	accessCookieName  = "token"
+	refreshCookieName = "refresh_token"
+)
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken is how opaque tokens are stored, so a database leak does not
+// hand out usable credentials.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func cookieModes() (bool, http.SameSite) {
+	if os.Getenv("ENVIRONMENT") == "dev" {
+		return false, http.SameSiteLaxMode
+	}
+	return true, http.SameSiteNoneMode
+}
+
+func setSessionCookies(w http.ResponseWriter, access string, refresh string, refreshExpiry time.Time) {
+	secMode, siteMode := cookieModes()
+	http.SetCookie(w, &http.Cookie{
+		Name:     accessCookieName,
+		Value:    fmt.Sprintf("Bearer %s", access),
+		HttpOnly: true,
+		Path:     "/",
+		SameSite: siteMode,
+		Secure:   secMode, // Set to true in production with HTTPS
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    refresh,
+		HttpOnly: true,
+		Path:     "/auth",
+		Expires:  refreshExpiry,
+		SameSite: siteMode,
+		Secure:   secMode,
+	})
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	secMode, siteMode := cookieModes()
+	for name, path := range map[string]string{accessCookieName: "/", refreshCookieName: "/auth"} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			HttpOnly: true,
+			Path:     path,
+			MaxAge:   -1,
+			SameSite: siteMode,
+			Secure:   secMode,
+		})
+	}
+}
+
+// startSession opens a new token family for user and sets the access and
+// refresh cookies on the response.
+func (s *Server) startSession(w http.ResponseWriter, user *models.User) error {
+	family := randomToken(16)
+	refresh := randomToken(32)
+	expiresAt := time.Now().Add(refreshTokenTTL)
+	if err := s.store.CreateRefreshToken(user.ID, family, hashToken(refresh), expiresAt); err != nil {
+		return err
+	}
+	access, err := GenerateJWT(user, family)
+	if err != nil {
+		return err
+	}
+	setSessionCookies(w, access, refresh, expiresAt)
+	return nil
+}
+
+// refreshSession exchanges a refresh token for a new access/refresh pair.
+func (s *Server) refreshSession(w http.ResponseWriter, refresh string) error {
+	next := randomToken(32)
+	token, err := s.store.RotateRefreshToken(hashToken(refresh), hashToken(next), time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		return err
+	}
+	user, err := s.store.FindUserById(token.UserID)
+	if err != nil {
+		return err
+	}
+	access, err := GenerateJWT(user, token.FamilyID)
+	if err != nil {
+		return err
+	}
+	setSessionCookies(w, access, next, token.ExpiresAt)
+	return nil
+}
+
+// endSession revokes the session identified by the request's refresh cookie,
+// falling back to the family in the access token when that is all we have.
+func (s *Server) endSession(r *http.Request) {
+	if cookie, err := r.Cookie(refreshCookieName); err == nil && cookie.Value != "" {
+		if err := s.store.RevokeRefreshToken(hashToken(cookie.Value)); err == nil {
+			return
+		}
+	}
+	cookie, err := r.Cookie(accessCookieName)
+	if err != nil {
+		return
+	}
+	tokenStr, _ := strings.CutPrefix(cookie.Value, "Bearer ")
+	if claims, err := m.ParseToken(tokenStr); err == nil && claims.Family != "" {
+		s.store.RevokeTokenFamily(claims.Family)
+	}
+}
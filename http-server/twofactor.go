@@ -0,0 +1,290 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/SourishBeast7/Glooo/totp"
+	"github.com/gorilla/mux"
+)
+
+const (
+	loginChallengeTTL = 5 * time.Minute
+	recoveryCodeCount = 10
+	// challengeCookie carries the login challenge after a redirect, where a
+	// query parameter would end up in history, logs and Referer headers.
+	challengeCookie = "login_challenge"
+	challengePath   = "/auth/login/2fa"
+)
+
+var errSecondFactor = errors.New("invalid authentication code")
+
+// beginLogin starts a session for user, unless they use two-factor
+// authentication; then it returns a challenge for /auth/login/2fa instead.
+func (s *Server) beginLogin(w http.ResponseWriter, user *models.User) (string, error) {
+	if user.TOTPEnabledAt == nil {
+		return "", s.startSession(w, user)
+	}
+	return s.issueUserToken(&models.UserToken{UserID: user.ID, Purpose: models.TokenLoginTwoStep}, loginChallengeTTL)
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code, and uses it up.
+func (s *Server) checkSecondFactor(user *models.User, code string, recoveryCode string) error {
+	if user.TOTPEnabledAt == nil || user.TOTPSecret == "" {
+		return errors.New("two-factor authentication is not on")
+	}
+	if code != "" {
+		step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+		if !ok || !s.store.UseTOTPStep(user.ID, step) {
+			return errSecondFactor
+		}
+		return nil
+	}
+	if recoveryCode != "" && s.store.UseRecoveryCode(user.ID, hashToken(normalizeRecoveryCode(recoveryCode))) {
+		return nil
+	}
+	return errSecondFactor
+}
+
+func setChallengeCookie(w http.ResponseWriter, challenge string) {
+	secMode, siteMode := cookieModes()
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookie,
+		Value:    challenge,
+		HttpOnly: true,
+		Path:     challengePath,
+		MaxAge:   int(loginChallengeTTL.Seconds()),
+		SameSite: siteMode,
+		Secure:   secMode,
+	})
+}
+
+func clearChallengeCookie(w http.ResponseWriter) {
+	secMode, siteMode := cookieModes()
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookie,
+		Value:    "",
+		HttpOnly: true,
+		Path:     challengePath,
+		MaxAge:   -1,
+		SameSite: siteMode,
+		Secure:   secMode,
+	})
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// newRecoveryCodes returns codes to show the user once, formatted XXXXX-XXXXX,
+// and the hashes to store.
+func newRecoveryCodes() ([]string, []string) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		raw := enc.EncodeToString(b)[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+		hashes[i] = hashToken(raw)
+	}
+	return codes, hashes
+}
+
+func totpIssuer() string {
+	if v := os.Getenv("TOTP_ISSUER"); v != "" {
+		return v
+	}
+	return "Glooo"
+}
+
+// Two-factor authentication
+
+func (s *Server) handleTwoFactorLogin(router *mux.Router) {
+	router.HandleFunc("/login/2fa", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		var body struct {
+			Challenge    string `json:"challenge"`
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recovery_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		// Password logins return the challenge in the response body; social
+		// logins leave it in a cookie on their redirect.
+		if body.Challenge == "" {
+			if cookie, err := r.Cookie(challengeCookie); err == nil {
+				body.Challenge = cookie.Value
+			}
+		}
+		id, nonceHash, err := parseUserToken(models.TokenLoginTwoStep, body.Challenge)
+		if err != nil {
+			return err
+		}
+		user, err := s.store.LoginChallengeUser(id, nonceHash)
+		if err != nil {
+			return err
+		}
+		if err := s.checkSecondFactor(user, body.Code, body.RecoveryCode); err != nil {
+			if ferr := s.store.FailLoginChallenge(id); ferr != nil {
+				log.Printf("%v", ferr)
+			}
+			return err
+		}
+		if err := s.store.CompleteLoginChallenge(id, nonceHash); err != nil {
+			return err
+		}
+		clearChallengeCookie(w)
+		if err := s.startSession(w, user); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	})).Methods(http.MethodPost)
+}
+
+func (s *Server) handleTwoFactorRoutes(router *mux.Router) {
+	router.HandleFunc("", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		user, err := s.store.FindUserById(p.UserID)
+		if err != nil {
+			return err
+		}
+		left, err := s.store.RecoveryCodesLeft(p.UserID)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"enabled":             user.TOTPEnabledAt != nil,
+			"recovery_codes_left": left,
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/setup", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		user, err := s.store.FindUserById(p.UserID)
+		if err != nil {
+			return err
+		}
+		secret := totp.NewSecret()
+		if err := s.store.BeginTOTPEnrollment(p.UserID, secret); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"secret":      secret,
+			"otpauth_uri": totp.URI(totpIssuer(), user.Email, secret),
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/enable", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		user, err := s.store.FindUserById(p.UserID)
+		if err != nil {
+			return err
+		}
+		if user.TOTPSecret == "" || user.TOTPEnabledAt != nil {
+			return errors.New("start two-factor setup first")
+		}
+		step, ok := totp.Validate(user.TOTPSecret, body.Code, time.Now())
+		if !ok {
+			return errSecondFactor
+		}
+		codes, hashes := newRecoveryCodes()
+		if err := s.store.EnableTOTP(p.UserID, step, hashes, p.Session); err != nil {
+			return err
+		}
+		// The plain codes are only ever shown here.
+		return WriteJson(w, http.StatusOK, Response{
+			"success":        true,
+			"recovery_codes": codes,
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/disable", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Password     string `json:"password"`
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recovery_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		if err := s.store.ConfirmPassword(p.UserID, body.Password); err != nil {
+			return err
+		}
+		user, err := s.store.FindUserById(p.UserID)
+		if err != nil {
+			return err
+		}
+		if err := s.checkSecondFactor(user, body.Code, body.RecoveryCode); err != nil {
+			return err
+		}
+		if err := s.store.DisableTOTP(p.UserID, p.Session); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/recovery-codes", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		user, err := s.store.FindUserById(p.UserID)
+		if err != nil {
+			return err
+		}
+		if err := s.checkSecondFactor(user, body.Code, ""); err != nil {
+			return err
+		}
+		codes, hashes := newRecoveryCodes()
+		if err := s.store.ReplaceRecoveryCodes(p.UserID, hashes); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success":        true,
+			"recovery_codes": codes,
+		})
+	}))).Methods(http.MethodPost)
+}
@@ -0,0 +1,256 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db"
+	"github.com/SourishBeast7/Glooo/db/models"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/gorilla/mux"
+)
+
+const (
+	verifyEmailTTL   = 48 * time.Hour
+	resetPasswordTTL = time.Hour
+	// mailCooldown is how long someone has to wait before asking for
+	// another link of the same kind.
+	mailCooldown = time.Minute
+)
+
+// tokenSecret keys the HMAC on tokens we hand out and later take back, such
+// as emailed links and the OAuth state cookie.
+func tokenSecret() []byte {
+	if v := os.Getenv("MAIL_TOKEN_SECRET"); v != "" {
+		return []byte(v)
+	}
+	return []byte(os.Getenv("JWT_SECRET"))
+}
+
+// appURL builds a link into the frontend, which lives at APP_URL.
+func appURL(path string, params url.Values) string {
+	base := os.Getenv("APP_URL")
+	if base == "" {
+		base = "http://localhost:5173"
+	}
+	link := strings.TrimSuffix(base, "/") + path
+	if len(params) > 0 {
+		link += "?" + params.Encode()
+	}
+	return link
+}
+
+// signToken is an HMAC over body that is only valid for purpose.
+func signToken(purpose string, body string) string {
+	mac := hmac.New(sha256.New, tokenSecret())
+	mac.Write([]byte(purpose + "." + body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueUserToken stores token and returns it in the form
+// <id>.<expiry>.<nonce>.<sig>. The signature binds it to the token's purpose;
+// the stored nonce hash makes it single use.
+func (s *Server) issueUserToken(token *models.UserToken, ttl time.Duration) (string, error) {
+	nonce := randomToken(32)
+	token.NonceHash = hashToken(nonce)
+	token.ExpiresAt = time.Now().Add(ttl)
+	if err := s.store.CreateUserToken(token); err != nil {
+		return "", err
+	}
+	body := fmt.Sprintf("%d.%d.%s", token.ID, token.ExpiresAt.Unix(), nonce)
+	return body + "." + signToken(token.Purpose, body), nil
+}
+
+// parseUserToken checks the signature and expiry of a token and returns
+// the stored token ID and the nonce hash to look it up by.
+func parseUserToken(purpose string, token string) (uint, string, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return 0, "", db.ErrUserTokenInvalid
+	}
+	body, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(signToken(purpose, body))) {
+		return 0, "", db.ErrUserTokenInvalid
+	}
+	parts := strings.SplitN(body, ".", 3)
+	if len(parts) != 3 {
+		return 0, "", db.ErrUserTokenInvalid
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", db.ErrUserTokenInvalid
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return 0, "", db.ErrUserTokenInvalid
+	}
+	return uint(id), hashToken(parts[2]), nil
+}
+
+func (s *Server) sendVerificationEmail(ctx context.Context, user *models.User) error {
+	token, err := s.issueUserToken(&models.UserToken{UserID: user.ID, Purpose: models.TokenVerifyEmail}, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hi %s,\n\nConfirm your email address for Glooo by opening this link:\n\n%s\n\nThe link expires in %d hours.\n",
+		user.Name, appURL("/verify-email", url.Values{"token": {token}}), int(verifyEmailTTL.Hours()))
+	return s.mail.Send(ctx, user.Email, "Confirm your email address", body)
+}
+
+func (s *Server) sendPasswordReset(ctx context.Context, user *models.User) error {
+	token, err := s.issueUserToken(&models.UserToken{UserID: user.ID, Purpose: models.TokenResetPassword}, resetPasswordTTL)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your Glooo account. If that was you, open this link to choose a new one:\n\n%s\n\nThe link expires in %d minutes. If you did not ask for this, you can ignore this email.\n",
+		user.Name, appURL("/reset-password", url.Values{"token": {token}}), int(resetPasswordTTL.Minutes()))
+	return s.mail.Send(ctx, user.Email, "Reset your password", body)
+}
+
+// sendEmailChange mails a confirmation link to the new address and a heads up
+// to the old one.
+func (s *Server) sendEmailChange(ctx context.Context, user *models.User, email string) error {
+	token, err := s.issueUserToken(&models.UserToken{UserID: user.ID, Purpose: models.TokenChangeEmail, NewEmail: email}, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hi %s,\n\nOpen this link to start using this address for your Glooo account:\n\n%s\n\nThe link expires in %d hours.\n",
+		user.Name, appURL("/confirm-email", url.Values{"token": {token}}), int(verifyEmailTTL.Hours()))
+	if err := s.mail.Send(ctx, email, "Confirm your new email address", body); err != nil {
+		return err
+	}
+	notice := fmt.Sprintf("Hi %s,\n\nSomeone asked to move your Glooo account to %s. Nothing changes until the new address is confirmed. If this was not you, change your password.\n",
+		user.Name, email)
+	if err := s.mail.Send(ctx, user.Email, "Your email address is being changed", notice); err != nil {
+		log.Printf("email change notice: %v", err)
+	}
+	return nil
+}
+
+// Email verification and password reset
+
+func (s *Server) handleVerificationRoutes(router *mux.Router) {
+	router.HandleFunc("/verify-email/request", m.AuthMiddleWare(s.store, makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, err := principal(r)
+		if err != nil {
+			return err
+		}
+		user, err := s.store.FindUserById(p.UserID)
+		if err != nil {
+			return err
+		}
+		if user.EmailVerifiedAt != nil {
+			return errors.New("email address is already verified")
+		}
+		if s.store.UserTokenIssuedSince(user.ID, models.TokenVerifyEmail, time.Now().Add(-mailCooldown)) {
+			return errors.New("please wait a minute before asking for another email")
+		}
+		if err := s.sendVerificationEmail(r.Context(), user); err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/verify-email/confirm", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		var body struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		id, nonceHash, err := parseUserToken(models.TokenVerifyEmail, body.Token)
+		if err != nil {
+			return err
+		}
+		if _, err := s.store.VerifyEmail(id, nonceHash); err != nil {
+			return err
+		}
+		// Access tokens carry the verified flag, so clients should call
+		// /auth/refresh to pick it up.
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	})).Methods(http.MethodPost)
+
+	router.HandleFunc("/email-change/confirm", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		var body struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		id, nonceHash, err := parseUserToken(models.TokenChangeEmail, body.Token)
+		if err != nil {
+			return err
+		}
+		user, err := s.store.ConfirmEmailChange(id, nonceHash)
+		if err != nil {
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+			"email":   user.Email,
+		})
+	})).Methods(http.MethodPost)
+
+	router.HandleFunc("/password-reset/request", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		var body struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		// The response is the same, and takes as long, whether or not the
+		// address has an account, so this cannot be used to find out who is
+		// registered. All the work happens after it has gone out.
+		go func() {
+			user, err := s.store.FindUserByEmailGorm(body.Email)
+			if err != nil || user.ID == 0 ||
+				s.store.UserTokenIssuedSince(user.ID, models.TokenResetPassword, time.Now().Add(-mailCooldown)) {
+				return
+			}
+			if err := s.sendPasswordReset(context.Background(), user); err != nil {
+				log.Printf("password reset: %v", err)
+			}
+		}()
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+			"message": "If that address has an account, a reset link is on its way",
+		})
+	})).Methods(http.MethodPost)
+
+	router.HandleFunc("/password-reset/confirm", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		var body struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		id, nonceHash, err := parseUserToken(models.TokenResetPassword, body.Token)
+		if err != nil {
+			return err
+		}
+		if err := s.store.ResetPassword(id, nonceHash, body.Password); err != nil {
+			return err
+		}
+		clearSessionCookies(w)
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	})).Methods(http.MethodPost)
+}
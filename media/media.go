@@ -0,0 +1,220 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound        = errors.New("media not found")
+	ErrTooLarge        = errors.New("file is too large")
+	ErrUnsupportedType = errors.New("file type is not allowed")
+	ErrInvalidKey      = errors.New("invalid media key")
+)
+
+const defaultMaxBytes = 10 << 20
+
+// MediaStore is a blob store addressed by slash separated keys.
+type MediaStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Open(ctx context.Context, key string) (io.ReadCloser, string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Object describes a file that was written to a MediaStore.
+type Object struct {
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+	// Width and Height are set for images whose format we can decode.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+}
+
+// Uploader validates files before handing them to a MediaStore and builds the
+// URLs they are served from.
+type Uploader struct {
+	Store    MediaStore
+	MaxBytes int64
+	// BaseURL is prepended to /media/<key> when building download URLs.
+	BaseURL string
+}
+
+func NewUploader(store MediaStore, maxBytes int64, baseURL string) *Uploader {
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBytes
+	}
+	return &Uploader{
+		Store:    store,
+		MaxBytes: maxBytes,
+		BaseURL:  strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// NewFromEnv builds an Uploader from MEDIA_BACKEND ("local" or "s3") and the
+// backend specific settings.
+func NewFromEnv() (*Uploader, error) {
+	maxBytes := int64(defaultMaxBytes)
+	if v := os.Getenv("MEDIA_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MEDIA_MAX_BYTES: %w", err)
+		}
+		maxBytes = n
+	}
+	var store MediaStore
+	switch backend := os.Getenv("MEDIA_BACKEND"); backend {
+	case "", "local":
+		dir := os.Getenv("MEDIA_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		local, err := NewLocalStore(dir)
+		if err != nil {
+			return nil, err
+		}
+		store = local
+	case "s3":
+		s3, err := NewS3Store(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Region:    os.Getenv("S3_REGION"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		store = s3
+	default:
+		return nil, fmt.Errorf("unknown MEDIA_BACKEND %q", backend)
+	}
+	log.Printf("📦 Media backend: %T", store)
+	return NewUploader(store, maxBytes, os.Getenv("MEDIA_PUBLIC_URL")), nil
+}
+
+// Save reads r fully (up to MaxBytes), sniffs its content type and stores it
+// under folder with a random name. When allowed is not empty the sniffed type
+// must start with one of its entries, e.g. "image/".
+func (u *Uploader) Save(ctx context.Context, r io.Reader, folder string, filename string, allowed ...string) (*Object, error) {
+	data, err := io.ReadAll(io.LimitReader(r, u.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > u.MaxBytes {
+		return nil, ErrTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	if !typeAllowed(contentType, allowed) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, contentType)
+	}
+	key := newKey(folder, contentType, filename)
+	if err := u.Store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		return nil, err
+	}
+	obj := &Object{
+		Key:         key,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		URL:         u.URL(key),
+	}
+	if strings.HasPrefix(contentType, "image/") {
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			obj.Width, obj.Height = cfg.Width, cfg.Height
+		}
+	}
+	return obj, nil
+}
+
+func (u *Uploader) URL(key string) string {
+	return u.BaseURL + "/media/" + key
+}
+
+func typeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if strings.HasPrefix(contentType, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// extensions pins the extension for common types, since mime.ExtensionsByType
+// returns them in alphabetical order (".jfif" before ".jpg").
+var extensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+	"text/plain":      ".txt",
+	"video/mp4":       ".mp4",
+	"audio/mpeg":      ".mp3",
+}
+
+func newKey(folder string, contentType string, filename string) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	ext := path.Ext(filename)
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	if known, ok := extensions[mediaType]; ok {
+		ext = known
+	} else if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		ext = exts[0]
+	}
+	if !safeExt(ext) {
+		ext = ""
+	}
+	return path.Join(folder, time.Now().UTC().Format("2006/01"), hex.EncodeToString(b)+ext)
+}
+
+func safeExt(ext string) bool {
+	if len(ext) > 10 {
+		return false
+	}
+	for i, c := range ext {
+		if i == 0 && c == '.' {
+			continue
+		}
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidKey rejects keys that could escape the store's namespace.
+func ValidKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,196 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func pngBytes(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestUploader(t *testing.T, maxBytes int64) (*Uploader, *LocalStore) {
+	t.Helper()
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewUploader(store, maxBytes, "https://cdn.example.test/"), store
+}
+
+func TestSaveSniffsContentType(t *testing.T) {
+	up, store := newTestUploader(t, 1<<20)
+	data := pngBytes(t, 3, 2)
+
+	// The client claims an executable; the bytes say otherwise.
+	obj, err := up.Save(context.Background(), bytes.NewReader(data), "pfp", "avatar.exe", "image/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.ContentType != "image/png" {
+		t.Errorf("ContentType = %q, want image/png", obj.ContentType)
+	}
+	if !strings.HasPrefix(obj.Key, "pfp/") || !strings.HasSuffix(obj.Key, ".png") {
+		t.Errorf("Key = %q, want pfp/.../*.png", obj.Key)
+	}
+	if obj.Width != 3 || obj.Height != 2 || obj.Size != int64(len(data)) {
+		t.Errorf("got %dx%d, %d bytes", obj.Width, obj.Height, obj.Size)
+	}
+	if obj.URL != "https://cdn.example.test/media/"+obj.Key {
+		t.Errorf("URL = %q", obj.URL)
+	}
+
+	rc, _, err := store.Open(context.Background(), obj.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if got, _ := io.ReadAll(rc); !bytes.Equal(got, data) {
+		t.Error("stored bytes differ from the upload")
+	}
+}
+
+func TestSaveRejectsDisallowedType(t *testing.T) {
+	up, _ := newTestUploader(t, 1<<20)
+	// A script renamed to .png still sniffs as text.
+	_, err := up.Save(context.Background(), strings.NewReader("<script>alert(1)</script>"), "pfp", "x.png", "image/")
+	if !errors.Is(err, ErrUnsupportedType) {
+		t.Fatalf("err = %v, want ErrUnsupportedType", err)
+	}
+}
+
+func TestSaveAllowsAnyTypeWithoutFilter(t *testing.T) {
+	up, _ := newTestUploader(t, 1<<20)
+	obj, err := up.Save(context.Background(), strings.NewReader("hello there"), "files", "notes.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(obj.ContentType, "text/plain") || !strings.HasSuffix(obj.Key, ".txt") {
+		t.Errorf("got %q stored as %q", obj.ContentType, obj.Key)
+	}
+}
+
+func TestSaveSizeLimit(t *testing.T) {
+	up, store := newTestUploader(t, 16)
+	ctx := context.Background()
+
+	if _, err := up.Save(ctx, strings.NewReader(strings.Repeat("a", 16)), "files", "ok.txt"); err != nil {
+		t.Fatalf("file at the limit: %v", err)
+	}
+	if _, err := up.Save(ctx, strings.NewReader(strings.Repeat("a", 17)), "files", "big.txt"); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("file over the limit: err = %v, want ErrTooLarge", err)
+	}
+
+	// Only the accepted file made it to disk.
+	var files int
+	filepath.WalkDir(store.dir, func(_ string, d os.DirEntry, _ error) error {
+		if d != nil && !d.IsDir() {
+			files++
+		}
+		return nil
+	})
+	if files != 1 {
+		t.Fatalf("%d files on disk, want 1", files)
+	}
+}
+
+func TestValidKey(t *testing.T) {
+	valid := []string{"a", "pfp/2024/01/abc.png", "files/x.y.z", "a/..b/c"}
+	invalid := []string{
+		"",
+		"/etc/passwd",
+		"..",
+		"../x",
+		"a/../../x",
+		"a/./b",
+		"a//b",
+		"a/",
+		`a\..\b`,
+		`C:\windows`,
+	}
+	for _, key := range valid {
+		if !ValidKey(key) {
+			t.Errorf("ValidKey(%q) = false", key)
+		}
+	}
+	for _, key := range invalid {
+		if ValidKey(key) {
+			t.Errorf("ValidKey(%q) = true", key)
+		}
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewLocalStore(filepath.Join(root, "media"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := store.Put(ctx, "files/a.txt", strings.NewReader("hi"), 2, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	rc, contentType, err := store.Open(ctx, "files/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(got) != "hi" || !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("Open = %q (%s)", got, contentType)
+	}
+	if err := store.Delete(ctx, "files/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Open(ctx, "files/a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open after delete: err = %v, want ErrNotFound", err)
+	}
+	if err := store.Delete(ctx, "files/a.txt"); err != nil {
+		t.Errorf("second Delete: %v", err)
+	}
+}
+
+func TestLocalStoreRejectsEscapes(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewLocalStore(filepath.Join(root, "media"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(root, "secret.txt")
+	if err := os.WriteFile(secret, []byte("keep out"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, key := range []string{"../secret.txt", "files/../../secret.txt", secret} {
+		if err := store.Put(ctx, key, strings.NewReader("owned"), 5, "text/plain"); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q): err = %v, want ErrInvalidKey", key, err)
+		}
+		if _, _, err := store.Open(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Open(%q): err = %v, want ErrInvalidKey", key, err)
+		}
+		if err := store.Delete(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Delete(%q): err = %v, want ErrInvalidKey", key, err)
+		}
+	}
+	if data, err := os.ReadFile(secret); err != nil || string(data) != "keep out" {
+		t.Fatalf("file outside the store was touched: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,172 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+const smtpTimeout = 30 * time.Second
+
+// MailSender sends a plain text email to one address.
+type MailSender interface {
+	Send(ctx context.Context, to string, subject string, body string) error
+}
+
+// LogMailer writes mail to the log instead of sending it. It stands in for
+// SMTP during local development.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	log.Printf("mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// Mailer sends plain text mail through an SMTP relay. STARTTLS is used when
+// the server offers it.
+type Mailer struct {
+	Addr string
+	From string
+	// Auth is optional; local relays and test sinks usually need none.
+	Auth smtp.Auth
+}
+
+// MailerFromEnv builds a Mailer from SMTP_ADDR, SMTP_FROM, SMTP_USERNAME and
+// SMTP_PASSWORD. It returns nil when SMTP_ADDR is not set.
+func MailerFromEnv() (*Mailer, error) {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_ADDR: %w", err)
+	}
+	from := os.Getenv("SMTP_FROM")
+	if _, err := mail.ParseAddress(from); err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	m := &Mailer{Addr: addr, From: from}
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		m.Auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return m, nil
+}
+
+// Send delivers one message to a single recipient.
+func (m *Mailer) Send(ctx context.Context, to string, subject string, body string) error {
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+	msg, err := m.compose(from, rcpt, subject, body)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: smtpTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(smtpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	host, _, _ := net.SplitHostPort(m.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server does not support AUTH")
+		}
+		if err := c.Auth(m.Auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(rcpt.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (m *Mailer) compose(from *mail.Address, to *mail.Address, subject string, body string) ([]byte, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(from.Address, "@"); at >= 0 {
+		domain = from.Address[at+1:]
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	// SMTP wants CRLF line endings throughout the body.
+	body = strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")
+	buf.WriteString(body)
+	if !strings.HasSuffix(body, "\r\n") {
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// EmailNotifier sends events to the user's account address.
+type EmailNotifier struct {
+	Mailer MailSender
+}
+
+func (n *EmailNotifier) Channel() string { return ChannelEmail }
+
+func (n *EmailNotifier) Notify(ctx context.Context, e *Event) error {
+	if e.User == nil || e.User.Email == "" {
+		return errors.New("event has no recipient address")
+	}
+	return n.Mailer.Send(ctx, e.User.Email, e.Subject, e.Body)
+}
@@ -0,0 +1,134 @@
+package notifications
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSink accepts a single message on a local listener, answering just
+// enough SMTP for net/smtp's client.
+type smtpSink struct {
+	addr string
+	done chan struct{}
+
+	from string
+	rcpt []string
+	data string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	sink := &smtpSink{addr: ln.Addr().String(), done: make(chan struct{})}
+	go func() {
+		defer close(sink.done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 sink ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch {
+			case verb == "EHLO" || verb == "HELO":
+				tp.PrintfLine("250-sink")
+				tp.PrintfLine("250 8BITMIME")
+			case strings.HasPrefix(strings.ToUpper(line), "MAIL FROM:"):
+				sink.from = strings.Fields(line[len("MAIL FROM:"):])[0]
+				tp.PrintfLine("250 OK")
+			case strings.HasPrefix(strings.ToUpper(line), "RCPT TO:"):
+				sink.rcpt = append(sink.rcpt, line[len("RCPT TO:"):])
+				tp.PrintfLine("250 OK")
+			case verb == "DATA":
+				tp.PrintfLine("354 go ahead")
+				lines, err := tp.ReadDotLines()
+				if err != nil {
+					return
+				}
+				sink.data = strings.Join(lines, "\n")
+				tp.PrintfLine("250 queued")
+			case verb == "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return sink
+}
+
+func TestMailerSend(t *testing.T) {
+	sink := newSMTPSink(t)
+	m := &Mailer{Addr: sink.addr, From: "Glooo <noreply@glooo.test>"}
+	body := "Hi Bob,\n\n.this line starts with a dot\nBye"
+	if err := m.Send(context.Background(), "bob@example.test", "Grüße from Glooo", body); err != nil {
+		t.Fatal(err)
+	}
+	<-sink.done
+
+	if sink.from != "<noreply@glooo.test>" {
+		t.Errorf("MAIL FROM = %q", sink.from)
+	}
+	if len(sink.rcpt) != 1 || sink.rcpt[0] != "<bob@example.test>" {
+		t.Errorf("RCPT TO = %q", sink.rcpt)
+	}
+	header, got, ok := strings.Cut(sink.data, "\n\n")
+	if !ok {
+		t.Fatalf("no header/body separator in %q", sink.data)
+	}
+	for _, want := range []string{
+		`From: "Glooo" <noreply@glooo.test>`,
+		"To: <bob@example.test>",
+		"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe_from_Glooo?=",
+		"Content-Type: text/plain; charset=UTF-8",
+		"Message-ID: <",
+	} {
+		if !strings.Contains(header, want) {
+			t.Errorf("header is missing %q:\n%s", want, header)
+		}
+	}
+	if got != body {
+		t.Errorf("body = %q, want %q", got, body)
+	}
+}
+
+func TestMailerRejectsBadRecipient(t *testing.T) {
+	m := &Mailer{Addr: "127.0.0.1:1", From: "noreply@glooo.test"}
+	if err := m.Send(context.Background(), "not an address", "s", "b"); err == nil {
+		t.Fatal("accepted an invalid recipient")
+	}
+}
+
+func TestMailerFromEnv(t *testing.T) {
+	t.Setenv("SMTP_ADDR", "")
+	if m, err := MailerFromEnv(); m != nil || err != nil {
+		t.Fatalf("unset: got %v, %v", m, err)
+	}
+	t.Setenv("SMTP_ADDR", "smtp.example.test")
+	if _, err := MailerFromEnv(); err == nil {
+		t.Fatal("accepted an address without a port")
+	}
+	t.Setenv("SMTP_ADDR", "smtp.example.test:587")
+	t.Setenv("SMTP_FROM", "noreply@glooo.test")
+	t.Setenv("SMTP_USERNAME", "user")
+	m, err := MailerFromEnv()
+	if err != nil || m.Auth == nil {
+		t.Fatalf("got %+v, %v", m, err)
+	}
+}
@@ -0,0 +1,35 @@
+package notifications
+
+import (
+	"context"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+)
+
+// Pusher sends a stored notification to the user's open connections.
+type Pusher interface {
+	PublishNotification(n *models.Notification)
+}
+
+// Inbox is the in-app channel: it stores notifications and pushes them over
+// the hub so that connected clients see them right away.
+type Inbox struct {
+	Store interface {
+		CreateNotification(n *models.Notification) error
+	}
+	Pusher Pusher
+}
+
+func (i *Inbox) Channel() string { return ChannelInbox }
+
+func (i *Inbox) Notify(ctx context.Context, e *Event) error {
+	for _, n := range e.Notifications {
+		if err := i.Store.CreateNotification(n); err != nil {
+			return err
+		}
+		if i.Pusher != nil {
+			i.Pusher.PublishNotification(n)
+		}
+	}
+	return nil
+}
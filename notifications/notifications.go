@@ -0,0 +1,363 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+)
+
+const (
+	ChannelInbox   = "inbox"
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+
+	// TypeDigest is the event type of a batch of notifications sent at once.
+	TypeDigest = "digest"
+
+	flushInterval = time.Minute
+	// maxDigestMessages caps how many message snippets go into one digest.
+	maxDigestMessages = 20
+)
+
+// Event is what a Notifier delivers: a single inbox notification or a digest
+// that bundles several of them with unread messages.
+type Event struct {
+	Type string       `json:"type"`
+	User *models.User `json:"-"`
+	// Settings are the recipient's, for channels that need per-user
+	// configuration such as the webhook.
+	Settings      *models.NotificationSettings `json:"-"`
+	Subject       string                       `json:"subject"`
+	Body          string                       `json:"body"`
+	Notifications []*models.Notification       `json:"notifications,omitempty"`
+	Messages      []*models.Message            `json:"messages,omitempty"`
+}
+
+// Notifier delivers events over one channel.
+type Notifier interface {
+	Channel() string
+	Notify(ctx context.Context, e *Event) error
+}
+
+// Store is the part of db.Storage the dispatcher needs.
+type Store interface {
+	CreateNotification(n *models.Notification) error
+	FindUserById(id uint) (*models.User, error)
+	GetNotificationSettings(userID uint) (*models.NotificationSettings, error)
+	IsChatMuted(chatID uint, userID uint) bool
+	IsBlockedEither(a uint, b uint) bool
+	UnreadMessageIDs(userID uint, ids []uint) ([]uint, error)
+}
+
+// Dispatcher routes notifications to the inbox and to whichever outside
+// channels each user has turned on. Outside deliveries that fall in quiet
+// hours, and all message notifications, are held and sent as a digest.
+type Dispatcher struct {
+	store    Store
+	inbox    Notifier
+	channels map[string]Notifier
+	now      func() time.Time
+
+	mu      sync.Mutex
+	pending map[uint]*batch
+}
+
+// batch is what is waiting to go out to one user. It lives in memory only;
+// the inbox keeps the durable copy.
+type batch struct {
+	since         time.Time
+	notifications []*models.Notification
+	messages      []*models.Message
+}
+
+func NewDispatcher(store Store, inbox Notifier, channels ...Notifier) *Dispatcher {
+	d := &Dispatcher{
+		store:    store,
+		inbox:    inbox,
+		channels: make(map[string]Notifier),
+		now:      time.Now,
+		pending:  make(map[uint]*batch),
+	}
+	for _, c := range channels {
+		d.channels[c.Channel()] = c
+	}
+	return d
+}
+
+// NewFromEnv builds a Dispatcher with a webhook channel, which users point
+// at their own URL, and an email channel when SMTP_ADDR is set.
+func NewFromEnv(store Store, pusher Pusher) (*Dispatcher, error) {
+	channels := []Notifier{NewWebhook()}
+	mailer, err := MailerFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if mailer != nil {
+		channels = append(channels, &EmailNotifier{Mailer: mailer})
+	}
+	return NewDispatcher(store, &Inbox{Store: store, Pusher: pusher}, channels...), nil
+}
+
+// Notify stores n in its owner's inbox and forwards it to their outside
+// channels. Notifications about someone the owner blocked, or who blocked
+// them, are dropped.
+func (d *Dispatcher) Notify(ctx context.Context, n *models.Notification) error {
+	if n.ActorID != nil && d.store.IsBlockedEither(n.UserID, *n.ActorID) {
+		return nil
+	}
+	if err := d.inbox.Notify(ctx, &Event{Type: n.Type, Notifications: []*models.Notification{n}}); err != nil {
+		return err
+	}
+	settings, err := d.store.GetNotificationSettings(n.UserID)
+	if err != nil {
+		return err
+	}
+	if !settings.FriendRequests || len(d.enabled(settings)) == 0 {
+		return nil
+	}
+	if InQuietHours(settings, d.now()) {
+		d.queue(n.UserID, func(b *batch) { b.notifications = append(b.notifications, n) })
+		return nil
+	}
+	user, err := d.store.FindUserById(n.UserID)
+	if err != nil {
+		return err
+	}
+	d.send(ctx, settings, &Event{
+		Type:          n.Type,
+		User:          user,
+		Subject:       describe(n),
+		Body:          describe(n) + ".",
+		Notifications: []*models.Notification{n},
+	})
+	return nil
+}
+
+// MessageStored queues msg for the digest of every recipient that wants
+// message notifications, has not muted the chat and is not blocked either
+// way with the sender.
+func (d *Dispatcher) MessageStored(msg *models.Message, recipients []uint) {
+	for _, id := range recipients {
+		if id == msg.SenderID {
+			continue
+		}
+		settings, err := d.store.GetNotificationSettings(id)
+		if err != nil {
+			log.Printf("notifications: %v", err)
+			continue
+		}
+		if !settings.Messages || len(d.enabled(settings)) == 0 || d.store.IsChatMuted(msg.ChatID, id) {
+			continue
+		}
+		if d.store.IsBlockedEither(id, msg.SenderID) {
+			continue
+		}
+		d.queue(id, func(b *batch) { b.messages = append(b.messages, msg) })
+	}
+}
+
+func (d *Dispatcher) queue(userID uint, add func(b *batch)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b, ok := d.pending[userID]
+	if !ok {
+		b = &batch{since: d.now()}
+		d.pending[userID] = b
+	}
+	add(b)
+}
+
+// Run sends due digests until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.Flush(ctx)
+		}
+	}
+}
+
+// Flush sends every digest that is due: outside the user's quiet hours and,
+// for message only batches, once the user's digest interval has passed.
+func (d *Dispatcher) Flush(ctx context.Context) {
+	now := d.now()
+	d.mu.Lock()
+	users := make([]uint, 0, len(d.pending))
+	for userID := range d.pending {
+		users = append(users, userID)
+	}
+	d.mu.Unlock()
+
+	for _, userID := range users {
+		settings, err := d.store.GetNotificationSettings(userID)
+		if err != nil {
+			log.Printf("notifications: %v", err)
+			continue
+		}
+		if InQuietHours(settings, now) {
+			continue
+		}
+		d.mu.Lock()
+		b, ok := d.pending[userID]
+		wait := time.Duration(settings.DigestMinutes) * time.Minute
+		if !ok || (len(b.notifications) == 0 && now.Sub(b.since) < wait) {
+			d.mu.Unlock()
+			continue
+		}
+		delete(d.pending, userID)
+		d.mu.Unlock()
+
+		if err := d.sendDigest(ctx, userID, settings, b); err != nil {
+			log.Printf("notifications: digest for user %d: %v", userID, err)
+		}
+	}
+}
+
+func (d *Dispatcher) sendDigest(ctx context.Context, userID uint, settings *models.NotificationSettings, b *batch) error {
+	messages, err := d.stillUnread(userID, b.messages)
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 && len(b.notifications) == 0 {
+		return nil
+	}
+	user, err := d.store.FindUserById(userID)
+	if err != nil {
+		return err
+	}
+
+	var body strings.Builder
+	for _, n := range b.notifications {
+		fmt.Fprintf(&body, "- %s\n", describe(n))
+	}
+	names := make(map[uint]string)
+	for i, msg := range messages {
+		if i == maxDigestMessages {
+			fmt.Fprintf(&body, "...and %d more messages\n", len(messages)-i)
+			break
+		}
+		name, ok := names[msg.SenderID]
+		if !ok {
+			name = "Someone"
+			if sender, err := d.store.FindUserById(msg.SenderID); err == nil {
+				name = sender.Name
+			}
+			names[msg.SenderID] = name
+		}
+		fmt.Fprintf(&body, "- %s: %s\n", name, snippet(msg))
+	}
+
+	d.send(ctx, settings, &Event{
+		Type:          TypeDigest,
+		User:          user,
+		Subject:       digestSubject(len(b.notifications), len(messages)),
+		Body:          body.String(),
+		Notifications: b.notifications,
+		Messages:      messages,
+	})
+	return nil
+}
+
+// stillUnread drops messages that were read, or whose chat was muted, while
+// they waited for the digest.
+func (d *Dispatcher) stillUnread(userID uint, messages []*models.Message) ([]*models.Message, error) {
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	ids := make([]uint, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	unread, err := d.store.UnreadMessageIDs(userID, ids)
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[uint]bool, len(unread))
+	for _, id := range unread {
+		keep[id] = true
+	}
+	out := make([]*models.Message, 0, len(unread))
+	muted := make(map[uint]bool)
+	for _, msg := range messages {
+		if !keep[msg.ID] {
+			continue
+		}
+		isMuted, ok := muted[msg.ChatID]
+		if !ok {
+			isMuted = d.store.IsChatMuted(msg.ChatID, userID)
+			muted[msg.ChatID] = isMuted
+		}
+		if !isMuted {
+			out = append(out, msg)
+		}
+	}
+	return out, nil
+}
+
+func (d *Dispatcher) enabled(settings *models.NotificationSettings) []Notifier {
+	out := make([]Notifier, 0, len(d.channels))
+	if c, ok := d.channels[ChannelEmail]; ok && settings.Email {
+		out = append(out, c)
+	}
+	if c, ok := d.channels[ChannelWebhook]; ok && settings.Webhook && settings.WebhookURL != "" {
+		out = append(out, c)
+	}
+	return out
+}
+
+func (d *Dispatcher) send(ctx context.Context, settings *models.NotificationSettings, e *Event) {
+	e.Settings = settings
+	for _, c := range d.enabled(settings) {
+		if err := c.Notify(ctx, e); err != nil {
+			log.Printf("notifications: %s: %v", c.Channel(), err)
+		}
+	}
+}
+
+func describe(n *models.Notification) string {
+	actor := "Someone"
+	if n.Actor != nil {
+		actor = n.Actor.Name
+	}
+	switch n.Type {
+	case models.NotifyFriendRequest:
+		return actor + " sent you a friend request"
+	case models.NotifyRequestAccepted:
+		return actor + " accepted your friend request"
+	case models.NotifyRequestDeclined:
+		return actor + " declined your friend request"
+	case models.NotifyRequestCanceled:
+		return actor + " cancelled their friend request"
+	}
+	return "You have a new notification"
+}
+
+func snippet(msg *models.Message) string {
+	text := strings.Join(strings.Fields(msg.Content), " ")
+	if text == "" {
+		return "sent an attachment"
+	}
+	if r := []rune(text); len(r) > 80 {
+		return string(r[:80]) + "…"
+	}
+	return text
+}
+
+func digestSubject(notifications int, messages int) string {
+	switch {
+	case messages == 0:
+		return fmt.Sprintf("You have %d new notifications", notifications)
+	case notifications == 0:
+		return fmt.Sprintf("You have %d unread messages", messages)
+	}
+	return fmt.Sprintf("You have %d unread messages and %d new notifications", messages, notifications)
+}
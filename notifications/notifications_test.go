@@ -0,0 +1,347 @@
+package notifications
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+	"gorm.io/gorm"
+)
+
+// fakeStore is an in-memory Store.
+type fakeStore struct {
+	mu       sync.Mutex
+	users    map[uint]*models.User
+	settings map[uint]*models.NotificationSettings
+	muted    map[[2]uint]bool // chat, user
+	blocked  map[[2]uint]bool // blocker, blocked
+	read     map[uint]bool    // message ids read by everyone
+	created  []*models.Notification
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		users: map[uint]*models.User{
+			1: {Model: gorm.Model{ID: 1}, Name: "Alice", Email: "alice@example.test"},
+			2: {Model: gorm.Model{ID: 2}, Name: "Bob", Email: "bob@example.test"},
+			3: {Model: gorm.Model{ID: 3}, Name: "Carol", Email: "carol@example.test"},
+		},
+		settings: map[uint]*models.NotificationSettings{},
+		muted:    map[[2]uint]bool{},
+		blocked:  map[[2]uint]bool{},
+		read:     map[uint]bool{},
+	}
+}
+
+func (f *fakeStore) CreateNotification(n *models.Notification) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n.ID = uint(len(f.created) + 1)
+	if n.ActorID != nil {
+		n.Actor = f.users[*n.ActorID]
+	}
+	f.created = append(f.created, n)
+	return nil
+}
+
+func (f *fakeStore) FindUserById(id uint) (*models.User, error) {
+	if u, ok := f.users[id]; ok {
+		return u, nil
+	}
+	return nil, errors.New("no such user")
+}
+
+func (f *fakeStore) GetNotificationSettings(userID uint) (*models.NotificationSettings, error) {
+	if s, ok := f.settings[userID]; ok {
+		return s, nil
+	}
+	return &models.NotificationSettings{
+		UserID:         userID,
+		Email:          true,
+		Messages:       true,
+		FriendRequests: true,
+		TimeZone:       "UTC",
+		DigestMinutes:  15,
+	}, nil
+}
+
+func (f *fakeStore) IsChatMuted(chatID uint, userID uint) bool {
+	return f.muted[[2]uint{chatID, userID}]
+}
+
+func (f *fakeStore) IsBlockedEither(a uint, b uint) bool {
+	return f.blocked[[2]uint{a, b}] || f.blocked[[2]uint{b, a}]
+}
+
+func (f *fakeStore) UnreadMessageIDs(userID uint, ids []uint) ([]uint, error) {
+	out := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !f.read[id] {
+			out = append(out, id)
+		}
+	}
+	return out, nil
+}
+
+// recorder is a Notifier that keeps what it was sent.
+type recorder struct {
+	channel string
+	mu      sync.Mutex
+	events  []*Event
+}
+
+func (r *recorder) Channel() string { return r.channel }
+
+func (r *recorder) Notify(ctx context.Context, e *Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+	return nil
+}
+
+type testClock struct{ t time.Time }
+
+func (c *testClock) now() time.Time          { return c.t }
+func (c *testClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestDispatcher(t *testing.T, start time.Time) (*Dispatcher, *fakeStore, *recorder, *testClock) {
+	t.Helper()
+	store := newFakeStore()
+	email := &recorder{channel: ChannelEmail}
+	d := NewDispatcher(store, &Inbox{Store: store}, email)
+	clock := &testClock{t: start}
+	d.now = clock.now
+	return d, store, email, clock
+}
+
+func friendRequest(to uint, from uint) *models.Notification {
+	return &models.Notification{Type: models.NotifyFriendRequest, UserID: to, ActorID: &from}
+}
+
+func message(id uint, chatID uint, senderID uint, content string) *models.Message {
+	return &models.Message{Model: gorm.Model{ID: id}, ChatID: chatID, SenderID: senderID, Content: content}
+}
+
+var noon = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestNotifySendsRightAway(t *testing.T) {
+	d, store, email, _ := newTestDispatcher(t, noon)
+	if err := d.Notify(context.Background(), friendRequest(2, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.created) != 1 {
+		t.Fatalf("%d inbox entries, want 1", len(store.created))
+	}
+	if len(email.events) != 1 {
+		t.Fatalf("%d emails, want 1", len(email.events))
+	}
+	e := email.events[0]
+	if e.User.ID != 2 || e.Subject != "Alice sent you a friend request" {
+		t.Fatalf("got email to %d: %q", e.User.ID, e.Subject)
+	}
+}
+
+func TestNotifyRespectsSettings(t *testing.T) {
+	d, store, email, _ := newTestDispatcher(t, noon)
+	store.settings[2] = &models.NotificationSettings{UserID: 2, Email: true, FriendRequests: false, TimeZone: "UTC", DigestMinutes: 15}
+	if err := d.Notify(context.Background(), friendRequest(2, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// The inbox is always on; only the outside channel is skipped.
+	if len(store.created) != 1 || len(email.events) != 0 {
+		t.Fatalf("inbox %d, email %d; want 1, 0", len(store.created), len(email.events))
+	}
+}
+
+func TestNotifySkipsBlockedActors(t *testing.T) {
+	for name, pair := range map[string][2]uint{
+		"owner blocked actor": {2, 1},
+		"actor blocked owner": {1, 2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d, store, email, _ := newTestDispatcher(t, noon)
+			store.blocked[pair] = true
+			if err := d.Notify(context.Background(), friendRequest(2, 1)); err != nil {
+				t.Fatal(err)
+			}
+			if len(store.created) != 0 || len(email.events) != 0 {
+				t.Fatalf("inbox %d, email %d; want nothing", len(store.created), len(email.events))
+			}
+		})
+	}
+}
+
+func TestNotifyHoldsDuringQuietHours(t *testing.T) {
+	night := time.Date(2024, 6, 1, 23, 30, 0, 0, time.UTC)
+	d, store, email, clock := newTestDispatcher(t, night)
+	store.settings[2] = &models.NotificationSettings{
+		UserID: 2, Email: true, FriendRequests: true,
+		QuietStart: "22:00", QuietEnd: "07:00", TimeZone: "UTC", DigestMinutes: 15,
+	}
+	ctx := context.Background()
+
+	if err := d.Notify(ctx, friendRequest(2, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Notify(ctx, friendRequest(2, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.created) != 2 {
+		t.Fatalf("%d inbox entries, want 2", len(store.created))
+	}
+	if len(email.events) != 0 {
+		t.Fatal("email sent during quiet hours")
+	}
+
+	// Still quiet after midnight.
+	clock.advance(3 * time.Hour)
+	d.Flush(ctx)
+	if len(email.events) != 0 {
+		t.Fatal("digest flushed during quiet hours")
+	}
+
+	clock.t = time.Date(2024, 6, 2, 7, 0, 0, 0, time.UTC)
+	d.Flush(ctx)
+	if len(email.events) != 1 {
+		t.Fatalf("%d emails after quiet hours, want one digest", len(email.events))
+	}
+	e := email.events[0]
+	if e.Type != TypeDigest || len(e.Notifications) != 2 || e.Subject != "You have 2 new notifications" {
+		t.Fatalf("unexpected digest %q with %d notifications", e.Subject, len(e.Notifications))
+	}
+	if !strings.Contains(e.Body, "Alice sent you a friend request") || !strings.Contains(e.Body, "Carol sent you a friend request") {
+		t.Fatalf("digest body is missing entries:\n%s", e.Body)
+	}
+
+	d.Flush(ctx)
+	if len(email.events) != 1 {
+		t.Fatal("digest was sent twice")
+	}
+}
+
+func TestMessageDigest(t *testing.T) {
+	d, store, email, clock := newTestDispatcher(t, noon)
+	ctx := context.Background()
+
+	d.MessageStored(message(10, 5, 1, "hello   there\nBob"), []uint{1, 2})
+	d.MessageStored(message(11, 5, 1, "are you around?"), []uint{1, 2})
+	d.MessageStored(message(12, 6, 3, ""), []uint{2, 3})
+	d.MessageStored(message(13, 7, 3, "read on another device"), []uint{2, 3})
+
+	if _, ok := d.pending[1]; ok {
+		t.Fatal("sender got a digest entry for their own message")
+	}
+
+	clock.advance(10 * time.Minute)
+	d.Flush(ctx)
+	if len(email.events) != 0 {
+		t.Fatal("message digest sent before the digest interval")
+	}
+
+	store.read[13] = true
+	clock.advance(5 * time.Minute)
+	d.Flush(ctx)
+	if len(email.events) != 1 {
+		t.Fatalf("%d emails, want one digest", len(email.events))
+	}
+	e := email.events[0]
+	if e.User.ID != 2 || len(e.Messages) != 3 || e.Subject != "You have 3 unread messages" {
+		t.Fatalf("digest to %d: %q with %d messages", e.User.ID, e.Subject, len(e.Messages))
+	}
+	want := "- Alice: hello there Bob\n- Alice: are you around?\n- Carol: sent an attachment\n"
+	if e.Body != want {
+		t.Fatalf("body = %q, want %q", e.Body, want)
+	}
+}
+
+func TestMessageDigestDropsEverythingRead(t *testing.T) {
+	d, store, email, clock := newTestDispatcher(t, noon)
+	d.MessageStored(message(10, 5, 1, "hi"), []uint{2})
+	store.read[10] = true
+	clock.advance(time.Hour)
+	d.Flush(context.Background())
+	if len(email.events) != 0 || len(d.pending) != 0 {
+		t.Fatalf("emails %d, pending %d; want none", len(email.events), len(d.pending))
+	}
+}
+
+func TestMessageStoredSkips(t *testing.T) {
+	tests := map[string]func(store *fakeStore){
+		"muted chat":           func(store *fakeStore) { store.muted[[2]uint{5, 2}] = true },
+		"blocked sender":       func(store *fakeStore) { store.blocked[[2]uint{2, 1}] = true },
+		"sender blocked owner": func(store *fakeStore) { store.blocked[[2]uint{1, 2}] = true },
+		"messages turned off": func(store *fakeStore) {
+			store.settings[2] = &models.NotificationSettings{UserID: 2, Email: true, Messages: false, TimeZone: "UTC", DigestMinutes: 15}
+		},
+		"no outside channel": func(store *fakeStore) {
+			store.settings[2] = &models.NotificationSettings{UserID: 2, Email: false, Messages: true, TimeZone: "UTC", DigestMinutes: 15}
+		},
+	}
+	for name, setup := range tests {
+		t.Run(name, func(t *testing.T) {
+			d, store, email, clock := newTestDispatcher(t, noon)
+			setup(store)
+			d.MessageStored(message(10, 5, 1, "hi"), []uint{2})
+			clock.advance(time.Hour)
+			d.Flush(context.Background())
+			if len(email.events) != 0 {
+				t.Fatalf("got %d emails, want none", len(email.events))
+			}
+		})
+	}
+}
+
+func TestMessageMutedWhileWaiting(t *testing.T) {
+	d, store, email, clock := newTestDispatcher(t, noon)
+	d.MessageStored(message(10, 5, 1, "in a muted chat"), []uint{2})
+	d.MessageStored(message(11, 6, 3, "in an open chat"), []uint{2})
+	store.muted[[2]uint{5, 2}] = true
+	clock.advance(time.Hour)
+	d.Flush(context.Background())
+	if len(email.events) != 1 || len(email.events[0].Messages) != 1 || email.events[0].Messages[0].ID != 11 {
+		t.Fatalf("unexpected digests: %+v", email.events)
+	}
+}
+
+func TestWebhookIsPerUser(t *testing.T) {
+	store := newFakeStore()
+	email := &recorder{channel: ChannelEmail}
+	hook := &recorder{channel: ChannelWebhook}
+	d := NewDispatcher(store, &Inbox{Store: store}, email, hook)
+	d.now = func() time.Time { return noon }
+	store.settings[2] = &models.NotificationSettings{
+		UserID: 2, Webhook: true, WebhookURL: "https://bob.example.test/hook", WebhookSecret: "bob-secret",
+		FriendRequests: true, TimeZone: "UTC", DigestMinutes: 15,
+	}
+	// User 3 keeps the defaults: email only.
+	ctx := context.Background()
+
+	if err := d.Notify(ctx, friendRequest(2, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Notify(ctx, friendRequest(3, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if len(hook.events) != 1 || hook.events[0].User.ID != 2 {
+		t.Fatalf("webhook got %d events, want only user 2's", len(hook.events))
+	}
+	if s := hook.events[0].Settings; s == nil || s.WebhookURL != "https://bob.example.test/hook" || s.WebhookSecret != "bob-secret" {
+		t.Fatalf("webhook event carries settings %+v", s)
+	}
+	if len(email.events) != 1 || email.events[0].User.ID != 3 {
+		t.Fatalf("email got %d events, want only user 3's", len(email.events))
+	}
+
+	// Turned on without a URL, the channel stays off.
+	store.settings[2].WebhookURL = ""
+	if err := d.Notify(ctx, friendRequest(2, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if len(hook.events) != 1 {
+		t.Fatal("webhook fired without a url")
+	}
+}
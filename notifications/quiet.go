@@ -0,0 +1,79 @@
+package notifications
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+)
+
+const maxDigestMinutes = 24 * 60
+
+// parseClock parses a wall clock time such as "22:30" into minutes after
+// midnight.
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: use HH:MM", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ValidateSettings checks user supplied settings and fills in defaults.
+func ValidateSettings(s *models.NotificationSettings) error {
+	if (s.QuietStart == "") != (s.QuietEnd == "") {
+		return errors.New("quiet hours need both a start and an end")
+	}
+	if s.QuietStart != "" {
+		if _, err := parseClock(s.QuietStart); err != nil {
+			return err
+		}
+		if _, err := parseClock(s.QuietEnd); err != nil {
+			return err
+		}
+	}
+	if s.TimeZone == "" {
+		s.TimeZone = "UTC"
+	}
+	if _, err := time.LoadLocation(s.TimeZone); err != nil {
+		return fmt.Errorf("unknown time zone %q", s.TimeZone)
+	}
+	if s.WebhookURL != "" {
+		if err := ValidateWebhookURL(s.WebhookURL); err != nil {
+			return err
+		}
+	}
+	if s.Webhook && s.WebhookURL == "" {
+		return errors.New("set a webhook url before turning the webhook on")
+	}
+	if s.DigestMinutes < 1 || s.DigestMinutes > maxDigestMinutes {
+		return fmt.Errorf("digest interval must be between 1 and %d minutes", maxDigestMinutes)
+	}
+	return nil
+}
+
+// InQuietHours reports whether t falls inside the user's quiet hours. The
+// window may wrap past midnight, e.g. 22:00 to 07:00.
+func InQuietHours(s *models.NotificationSettings, t time.Time) bool {
+	if s.QuietStart == "" || s.QuietEnd == "" {
+		return false
+	}
+	start, err := parseClock(s.QuietStart)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(s.QuietEnd)
+	if err != nil {
+		return false
+	}
+	if loc, err := time.LoadLocation(s.TimeZone); err == nil {
+		t = t.In(loc)
+	}
+	now := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
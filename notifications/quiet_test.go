@@ -0,0 +1,71 @@
+package notifications
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+)
+
+func TestInQuietHours(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2024, 1, 15, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name       string
+		start, end string
+		zone       string
+		t          time.Time
+		want       bool
+	}{
+		{"not set", "", "", "UTC", at(3, 0), false},
+		{"same day inside", "13:00", "14:30", "UTC", at(14, 0), true},
+		{"same day at start", "13:00", "14:30", "UTC", at(13, 0), true},
+		{"same day at end", "13:00", "14:30", "UTC", at(14, 30), false},
+		{"same day before", "13:00", "14:30", "UTC", at(12, 59), false},
+		{"wrapping before midnight", "22:00", "07:00", "UTC", at(23, 15), true},
+		{"wrapping at start", "22:00", "07:00", "UTC", at(22, 0), true},
+		{"wrapping after midnight", "22:00", "07:00", "UTC", at(0, 30), true},
+		{"wrapping just before end", "22:00", "07:00", "UTC", at(6, 59), true},
+		{"wrapping at end", "22:00", "07:00", "UTC", at(7, 0), false},
+		{"wrapping daytime", "22:00", "07:00", "UTC", at(12, 0), false},
+		{"wrapping just before start", "22:00", "07:00", "UTC", at(21, 59), false},
+		// 21:30 UTC is 06:30 in Tokyo and 16:30 in New York.
+		{"user time zone inside", "22:00", "07:00", "Asia/Tokyo", at(21, 30), true},
+		{"user time zone outside", "22:00", "07:00", "America/New_York", at(21, 30), false},
+		{"user time zone wraps the UTC day", "22:00", "07:00", "America/New_York", at(4, 0), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &models.NotificationSettings{QuietStart: tt.start, QuietEnd: tt.end, TimeZone: tt.zone}
+			if got := InQuietHours(s, tt.t); got != tt.want {
+				t.Fatalf("InQuietHours(%s-%s %s, %s) = %v, want %v", tt.start, tt.end, tt.zone, tt.t.Format(time.Kitchen), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	valid := &models.NotificationSettings{QuietStart: "22:00", QuietEnd: "07:00", DigestMinutes: 15}
+	if err := ValidateSettings(valid); err != nil {
+		t.Fatal(err)
+	}
+	if valid.TimeZone != "UTC" {
+		t.Errorf("TimeZone = %q, want the UTC default", valid.TimeZone)
+	}
+
+	invalid := map[string]*models.NotificationSettings{
+		"start only":          {QuietStart: "22:00", DigestMinutes: 15},
+		"bad clock":           {QuietStart: "25:00", QuietEnd: "07:00", DigestMinutes: 15},
+		"bad zone":            {TimeZone: "Mars/Olympus", DigestMinutes: 15},
+		"digest too low":      {DigestMinutes: 0},
+		"digest too high":     {DigestMinutes: maxDigestMinutes + 1},
+		"webhook without url": {Webhook: true, DigestMinutes: 15},
+		"plain http webhook":  {WebhookURL: "http://hooks.example.test", DigestMinutes: 15},
+	}
+	for name, s := range invalid {
+		if err := ValidateSettings(s); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
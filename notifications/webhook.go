@@ -0,0 +1,154 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db/models"
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+	maxWebhookURL  = 2048
+)
+
+// Webhook POSTs events as JSON to the URL each user set in their
+// notification settings. Bodies are signed with HMAC-SHA256 using that
+// user's own secret and sent in the X-Glooo-Signature header.
+type Webhook struct {
+	// Client is used for every request. The default refuses to connect to
+	// loopback and private addresses, so users cannot point it inward.
+	Client *http.Client
+}
+
+func NewWebhook() *Webhook {
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: refusePrivate}
+	return &Webhook{Client: &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: webhookTimeout},
+		// A redirect could lead somewhere the URL check never saw.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}}
+}
+
+// refusePrivate runs after DNS resolution, so it also catches names that
+// resolve to internal addresses.
+func refusePrivate(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(ip) {
+		return fmt.Errorf("webhook: refusing to connect to %s", ip)
+	}
+	return nil
+}
+
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() || ip.IsInterfaceLocalMulticast())
+}
+
+// NewWebhookSecret returns a random signing secret for a user's webhook.
+func NewWebhookSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ValidateWebhookURL accepts absolute https URLs that do not name a local
+// or private host.
+func ValidateWebhookURL(raw string) error {
+	if len(raw) > maxWebhookURL {
+		return errors.New("webhook url is too long")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" || u.User != nil {
+		return errors.New("webhook url must be an https:// address")
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errors.New("webhook url must not point at a local host")
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !publicAddr(ip) {
+		return errors.New("webhook url must not point at a private address")
+	}
+	return nil
+}
+
+type webhookPayload struct {
+	Type          string                 `json:"type"`
+	UserID        uint                   `json:"user_id"`
+	Subject       string                 `json:"subject"`
+	Body          string                 `json:"body"`
+	Notifications []*models.Notification `json:"notifications,omitempty"`
+	SentAt        time.Time              `json:"sent_at"`
+}
+
+func (w *Webhook) Channel() string { return ChannelWebhook }
+
+func (w *Webhook) Notify(ctx context.Context, e *Event) error {
+	if e.Settings == nil || e.Settings.WebhookURL == "" {
+		return errors.New("event has no webhook url")
+	}
+	payload := webhookPayload{
+		Type:          e.Type,
+		Subject:       e.Subject,
+		Body:          e.Body,
+		Notifications: e.Notifications,
+		SentAt:        time.Now().UTC(),
+	}
+	if e.User != nil {
+		payload.UserID = e.User.ID
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Settings.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.Settings.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(e.Settings.WebhookSecret))
+		mac.Write(body)
+		req.Header.Set("X-Glooo-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", res.Status)
+	}
+	return nil
+}
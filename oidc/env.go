@@ -0,0 +1,61 @@
+package oidc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Well known providers only need a client ID and secret.
+var presets = map[string]Config{
+	"google": {
+		Issuer: "https://accounts.google.com",
+		Scopes: []string{"openid", "email", "profile"},
+	},
+	"github": {
+		AuthURL:     "https://github.com/login/oauth/authorize",
+		TokenURL:    "https://github.com/login/oauth/access_token",
+		UserInfoURL: "https://api.github.com/user",
+		Scopes:      []string{"read:user", "user:email"},
+	},
+}
+
+// ProvidersFromEnv builds the providers named in OIDC_PROVIDERS, e.g.
+// "google,github". Each one reads OIDC_<NAME>_CLIENT_ID and
+// OIDC_<NAME>_CLIENT_SECRET, and OIDC_<NAME>_ISSUER for providers without a
+// preset. Callbacks go to OIDC_REDIRECT_BASE/auth/oauth/<name>/callback.
+func ProvidersFromEnv() (map[string]*Provider, error) {
+	providers := make(map[string]*Provider)
+	names := os.Getenv("OIDC_PROVIDERS")
+	if names == "" {
+		return providers, nil
+	}
+	base := strings.TrimSuffix(os.Getenv("OIDC_REDIRECT_BASE"), "/")
+	if base == "" {
+		base = "http://localhost:3000"
+	}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		env := "OIDC_" + strings.ToUpper(name) + "_"
+		cfg := presets[name]
+		cfg.Name = name
+		cfg.ClientID = os.Getenv(env + "CLIENT_ID")
+		cfg.ClientSecret = os.Getenv(env + "CLIENT_SECRET")
+		cfg.RedirectURL = base + "/auth/oauth/" + name + "/callback"
+		if v := os.Getenv(env + "ISSUER"); v != "" {
+			cfg.Issuer = v
+		}
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = []string{"openid", "email", "profile"}
+		}
+		p, err := NewProvider(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", env+"*", err)
+		}
+		providers[name] = p
+	}
+	return providers, nil
+}
@@ -0,0 +1,116 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// flexBool accepts both true and "true"; some providers send email_verified
+// as a string.
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch t := v.(type) {
+	case bool:
+		*b = flexBool(t)
+	case string:
+		*b = flexBool(strings.EqualFold(t, "true"))
+	}
+	return nil
+}
+
+type idClaims struct {
+	Email         string   `json:"email"`
+	EmailVerified flexBool `json:"email_verified"`
+	Name          string   `json:"name"`
+	Picture       string   `json:"picture"`
+	Nonce         string   `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+func (p *Provider) verifyIDToken(ctx context.Context, d *discovery, raw string, nonce string) (*Identity, error) {
+	if raw == "" {
+		return nil, errors.New("oidc: token response has no id_token")
+	}
+	claims := new(idClaims)
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.keys.key(ctx, p, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return nil, errors.New("oidc: id token nonce does not match")
+	}
+	return &Identity{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+		Picture:       claims.Picture,
+	}, nil
+}
+
+// userInfo reads the identity of a plain OAuth2 provider. The response shape
+// is GitHub's; its email list is consulted when the profile hides the address.
+func (p *Provider) userInfo(ctx context.Context, d *discovery, accessToken string) (*Identity, error) {
+	var user struct {
+		ID        json.Number `json:"id"`
+		Sub       string      `json:"sub"`
+		Login     string      `json:"login"`
+		Name      string      `json:"name"`
+		Email     string      `json:"email"`
+		AvatarURL string      `json:"avatar_url"`
+		Picture   string      `json:"picture"`
+	}
+	if err := p.getJSON(ctx, d.UserInfoURL, accessToken, &user); err != nil {
+		return nil, err
+	}
+	id := &Identity{
+		Subject: user.Sub,
+		Name:    user.Name,
+		Email:   user.Email,
+		Picture: user.AvatarURL,
+	}
+	if id.Subject == "" {
+		id.Subject = user.ID.String()
+	}
+	if id.Name == "" {
+		id.Name = user.Login
+	}
+	if id.Picture == "" {
+		id.Picture = user.Picture
+	}
+
+	// A userinfo email is only trusted once the provider's email list says it
+	// is verified.
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := p.getJSON(ctx, strings.TrimSuffix(d.UserInfoURL, "/")+"/emails", accessToken, &emails); err == nil {
+		for _, e := range emails {
+			if e.Primary && e.Verified {
+				id.Email, id.EmailVerified = e.Email, true
+				break
+			}
+		}
+	}
+	return id, nil
+}
@@ -0,0 +1,92 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A provider rotating its keys is the only reason to see an unknown key ID,
+// so refetching is rate limited to stop bad tokens from hammering the JWKS.
+const minKeyRefresh = time.Minute
+
+// keySet caches a provider's RSA signing keys by key ID.
+type keySet struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func newKeySet(url string, client *http.Client) *keySet {
+	return &keySet{url: url, client: client}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (k *keySet) key(ctx context.Context, p *Provider, kid string) (*rsa.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(k.fetched) < minKeyRefresh {
+		return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, k.url, "", &set); err != nil {
+		return nil, fmt.Errorf("oidc: jwks: %w", err)
+	}
+	k.fetched = time.Now()
+	k.keys = make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, j := range set.Keys {
+		if j.Kty != "RSA" || (j.Use != "" && j.Use != "sig") {
+			continue
+		}
+		pub, err := j.rsaKey()
+		if err != nil {
+			continue
+		}
+		k.keys[j.Kid] = pub
+	}
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+}
+
+func (j jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(j.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(j.E)
+	if err != nil {
+		return nil, err
+	}
+	if len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("bad exponent")
+	}
+	exp := 0
+	for _, b := range e {
+		exp = exp<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+}
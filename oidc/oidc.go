@@ -0,0 +1,259 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown sign in provider")
+	ErrNoEmail         = errors.New("provider did not return an email address")
+)
+
+const requestTimeout = 15 * time.Second
+
+// Config describes one identity provider. With an Issuer the endpoints are
+// found through OpenID discovery and ID tokens are verified against the
+// provider's JWKS. Without one, AuthURL, TokenURL and UserInfoURL must be
+// set and the identity comes from the userinfo endpoint (GitHub works this
+// way, as it does not speak OpenID Connect).
+type Config struct {
+	Name         string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	Issuer      string
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+
+	// Client is used for every request; http.DefaultClient when nil.
+	Client *http.Client
+}
+
+// Provider runs the authorization code flow with PKCE against one identity
+// provider.
+type Provider struct {
+	cfg Config
+
+	mu        sync.Mutex
+	endpoints *discovery
+	keys      *keySet
+}
+
+type discovery struct {
+	Issuer      string `json:"issuer"`
+	AuthURL     string `json:"authorization_endpoint"`
+	TokenURL    string `json:"token_endpoint"`
+	UserInfoURL string `json:"userinfo_endpoint"`
+	JWKSURL     string `json:"jwks_uri"`
+}
+
+// Identity is the user as the provider knows them.
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+}
+
+// Token is the token endpoint's response.
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+}
+
+func NewProvider(cfg Config) (*Provider, error) {
+	if cfg.Name == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("oidc: name, client id and redirect url are required")
+	}
+	if cfg.Issuer == "" && (cfg.AuthURL == "" || cfg.TokenURL == "" || cfg.UserInfoURL == "") {
+		return nil, fmt.Errorf("oidc: %s needs an issuer or explicit endpoints", cfg.Name)
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	p := &Provider{cfg: cfg}
+	if cfg.Issuer == "" {
+		p.endpoints = &discovery{AuthURL: cfg.AuthURL, TokenURL: cfg.TokenURL, UserInfoURL: cfg.UserInfoURL}
+	}
+	return p, nil
+}
+
+func (p *Provider) Name() string { return p.cfg.Name }
+
+// discover fetches the provider's metadata once; a failure is retried on the
+// next call.
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+	issuer := strings.TrimSuffix(p.cfg.Issuer, "/")
+	d := new(discovery)
+	if err := p.getJSON(ctx, issuer+"/.well-known/openid-configuration", "", d); err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc: discovery returned issuer %q, want %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthURL == "" || d.TokenURL == "" || d.JWKSURL == "" {
+		return nil, errors.New("oidc: discovery document is missing endpoints")
+	}
+	p.endpoints = d
+	p.keys = newKeySet(d.JWKSURL, p.cfg.Client)
+	return d, nil
+}
+
+// NewVerifier returns a random PKCE code verifier. It is also fine to use as
+// state or nonce.
+func NewVerifier() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Challenge is the S256 PKCE challenge for verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL is where to send the user to sign in.
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, verifier string, nonce string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(d.AuthURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("code_challenge", Challenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	if p.cfg.Issuer != "" {
+		q.Set("nonce", nonce)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange trades an authorization code for tokens.
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string) (*Token, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	if p.cfg.ClientSecret != "" {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	res, err := p.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Token
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, fmt.Errorf("oidc: token endpoint returned %s", res.Status)
+	}
+	if out.Error != "" {
+		return nil, fmt.Errorf("oidc: token endpoint: %s %s", out.Error, out.Description)
+	}
+	if res.StatusCode != http.StatusOK || out.AccessToken == "" {
+		return nil, fmt.Errorf("oidc: token endpoint returned %s", res.Status)
+	}
+	return &out.Token, nil
+}
+
+// Identity works out who signed in. For OpenID providers the ID token is
+// verified, including nonce; otherwise the userinfo endpoint is asked.
+func (p *Provider) Identity(ctx context.Context, tok *Token, nonce string) (*Identity, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var id *Identity
+	if p.cfg.Issuer != "" {
+		id, err = p.verifyIDToken(ctx, d, tok.IDToken, nonce)
+	} else {
+		id, err = p.userInfo(ctx, d, tok.AccessToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+	id.Provider = p.cfg.Name
+	if id.Subject == "" {
+		return nil, errors.New("oidc: identity has no subject")
+	}
+	return id, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, endpoint string, accessToken string, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	res, err := p.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", endpoint, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
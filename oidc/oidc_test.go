@@ -0,0 +1,332 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockProvider is a local OpenID provider. It remembers the PKCE challenge
+// from the authorization request and only issues tokens for its verifier.
+type mockProvider struct {
+	t      *testing.T
+	srv    *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+	claims jwt.MapClaims
+
+	challenge string
+	emails    []map[string]any
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := &mockProvider{t: t, key: key, kid: "key-1"}
+	mux := http.NewServeMux()
+	discovery := func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 mp.srv.URL,
+			"authorization_endpoint": mp.srv.URL + "/authorize",
+			"token_endpoint":         mp.srv.URL + "/token",
+			"userinfo_endpoint":      mp.srv.URL + "/user",
+			"jwks_uri":               mp.srv.URL + "/jwks",
+		})
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", discovery)
+	// Served under another path but still claiming the root issuer.
+	mux.HandleFunc("/other/.well-known/openid-configuration", discovery)
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.Form.Get("code") != "good-code" || Challenge(r.Form.Get("code_verifier")) != mp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		res := map[string]string{"access_token": "access-token", "token_type": "Bearer"}
+		if mp.claims != nil {
+			tok := jwt.NewWithClaims(jwt.SigningMethodRS256, mp.claims)
+			tok.Header["kid"] = mp.kid
+			signed, err := tok.SignedString(mp.key)
+			if err != nil {
+				t.Error(err)
+			}
+			res["id_token"] = signed
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"id": 4242, "login": "octo", "email": nil, "avatar_url": "https://example.test/a.png"})
+	})
+	mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(mp.emails)
+	})
+	mp.srv = httptest.NewServer(mux)
+	t.Cleanup(mp.srv.Close)
+	return mp
+}
+
+func (mp *mockProvider) validClaims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            mp.srv.URL,
+		"aud":            "client-1",
+		"sub":            "user-1",
+		"email":          "alice@example.test",
+		"email_verified": true,
+		"name":           "Alice",
+		"nonce":          nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+}
+
+func (mp *mockProvider) oidcProvider(t *testing.T) *Provider {
+	t.Helper()
+	p, err := NewProvider(Config{
+		Name:        "mock",
+		ClientID:    "client-1",
+		RedirectURL: "http://localhost/callback",
+		Scopes:      []string{"openid", "email"},
+		Issuer:      mp.srv.URL,
+		Client:      mp.srv.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// authorize runs the browser leg: it builds the auth URL and records the
+// challenge the provider would have seen.
+func (mp *mockProvider) authorize(t *testing.T, p *Provider, verifier string, nonce string) url.Values {
+	t.Helper()
+	raw, err := p.AuthCodeURL(context.Background(), "state-1", verifier, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	mp.challenge = q.Get("code_challenge")
+	return q
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	mp := newMockProvider(t)
+	p := mp.oidcProvider(t)
+	verifier := NewVerifier()
+	q := mp.authorize(t, p, verifier, "nonce-1")
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             "client-1",
+		"redirect_uri":          "http://localhost/callback",
+		"state":                 "state-1",
+		"nonce":                 "nonce-1",
+		"code_challenge":        Challenge(verifier),
+		"code_challenge_method": "S256",
+		"scope":                 "openid email",
+	}
+	for k, v := range want {
+		if got := q.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestChallengeRFC7636(t *testing.T) {
+	// Appendix B of RFC 7636.
+	got := Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Fatalf("Challenge = %q, want %q", got, want)
+	}
+}
+
+func TestExchangeAndIdentity(t *testing.T) {
+	mp := newMockProvider(t)
+	p := mp.oidcProvider(t)
+	verifier := NewVerifier()
+	mp.authorize(t, p, verifier, "nonce-1")
+	mp.claims = mp.validClaims("nonce-1")
+
+	tok, err := p.Exchange(context.Background(), "good-code", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := p.Identity(context.Background(), tok, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Provider != "mock" || id.Subject != "user-1" || id.Email != "alice@example.test" || !id.EmailVerified || id.Name != "Alice" {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	mp := newMockProvider(t)
+	p := mp.oidcProvider(t)
+	mp.authorize(t, p, NewVerifier(), "nonce-1")
+	mp.claims = mp.validClaims("nonce-1")
+
+	_, err := p.Exchange(context.Background(), "good-code", NewVerifier())
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("err = %v, want invalid_grant", err)
+	}
+}
+
+func TestIdentityRejectsBadIDTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(mp *mockProvider, c jwt.MapClaims)
+		nonce  string
+	}{
+		{"nonce mismatch", func(mp *mockProvider, c jwt.MapClaims) {}, "other-nonce"},
+		{"wrong audience", func(mp *mockProvider, c jwt.MapClaims) { c["aud"] = "someone-else" }, "nonce-1"},
+		{"wrong issuer", func(mp *mockProvider, c jwt.MapClaims) { c["iss"] = "https://evil.example.test" }, "nonce-1"},
+		{"expired", func(mp *mockProvider, c jwt.MapClaims) {
+			c["iat"] = time.Now().Add(-2 * time.Hour).Unix()
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+		}, "nonce-1"},
+		{"unknown kid", func(mp *mockProvider, c jwt.MapClaims) { mp.kid = "rotated-away" }, "nonce-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mp := newMockProvider(t)
+			p := mp.oidcProvider(t)
+			verifier := NewVerifier()
+			mp.authorize(t, p, verifier, "nonce-1")
+			mp.claims = mp.validClaims("nonce-1")
+			tt.mutate(mp, mp.claims)
+
+			tok, err := p.Exchange(context.Background(), "good-code", verifier)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id, err := p.Identity(context.Background(), tok, tt.nonce); err == nil {
+				t.Fatalf("accepted bad id token: %+v", id)
+			}
+		})
+	}
+}
+
+func TestIdentityRejectsWrongSigningKey(t *testing.T) {
+	mp := newMockProvider(t)
+	p := mp.oidcProvider(t)
+	verifier := NewVerifier()
+	mp.authorize(t, p, verifier, "nonce-1")
+	mp.claims = mp.validClaims("nonce-1")
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.key = other
+
+	tok, err := p.Exchange(context.Background(), "good-code", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Identity(context.Background(), tok, "nonce-1"); err == nil {
+		t.Fatal("accepted id token signed by an unknown key")
+	}
+}
+
+func TestGitHubEmailFallback(t *testing.T) {
+	mp := newMockProvider(t)
+	p, err := NewProvider(Config{
+		Name:        "github",
+		ClientID:    "client-1",
+		RedirectURL: "http://localhost/callback",
+		AuthURL:     mp.srv.URL + "/authorize",
+		TokenURL:    mp.srv.URL + "/token",
+		UserInfoURL: mp.srv.URL + "/user",
+		Client:      mp.srv.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewVerifier()
+	if q := mp.authorize(t, p, verifier, "unused"); q.Get("nonce") != "" {
+		t.Errorf("plain OAuth2 provider was sent a nonce")
+	}
+	mp.emails = []map[string]any{
+		{"email": "old@example.test", "primary": false, "verified": true},
+		{"email": "octo@example.test", "primary": true, "verified": true},
+	}
+
+	tok, err := p.Exchange(context.Background(), "good-code", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := p.Identity(context.Background(), tok, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Subject != "4242" || id.Name != "octo" || id.Email != "octo@example.test" || !id.EmailVerified {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+
+	// An unverified primary address must not come back as verified.
+	mp.emails = []map[string]any{{"email": "octo@example.test", "primary": true, "verified": false}}
+	id, err = p.Identity(context.Background(), tok, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.EmailVerified {
+		t.Fatalf("unverified email reported as verified: %+v", id)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	mp := newMockProvider(t)
+	p, err := NewProvider(Config{
+		Name:        "mock",
+		ClientID:    "client-1",
+		RedirectURL: "http://localhost/callback",
+		Issuer:      mp.srv.URL + "/other",
+		Client:      mp.srv.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.AuthCodeURL(context.Background(), "s", NewVerifier(), "n")
+	if err == nil || !strings.Contains(err.Error(), "discovery returned issuer") {
+		t.Fatalf("err = %v, want issuer mismatch", err)
+	}
+}
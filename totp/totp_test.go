@@ -0,0 +1,113 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of the RFC 4226 and RFC 6238 test vectors.
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeRFC6238(t *testing.T) {
+	// RFC 6238 Appendix B, SHA1 rows. The RFC prints 8 digits; a 6 digit
+	// code is the same value truncated to its last 6.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		at := time.Unix(tt.unix, 0)
+		want := tt.want[len(tt.want)-Digits:]
+		got, err := Code(rfcSecret, Step(at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, want)
+		}
+		step, ok := Validate(rfcSecret, want, at)
+		if !ok || step != Step(at) {
+			t.Errorf("Validate at %d = %d, %v; want %d, true", tt.unix, step, ok, Step(at))
+		}
+	}
+}
+
+func TestCodeRFC4226(t *testing.T) {
+	// RFC 4226 Appendix D: HOTP values for counters 0 to 9.
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, w := range want {
+		got, err := Code(rfcSecret, int64(counter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != w {
+			t.Errorf("Code(%d) = %s, want %s", counter, got, w)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	at := time.Unix(1111111111, 0)
+	now := Step(at)
+	for offset, wantOK := range map[int64]bool{-2: false, -1: true, 0: true, 1: true, 2: false} {
+		code, err := Code(rfcSecret, now+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := Validate(rfcSecret, code, at)
+		if ok != wantOK || (ok && step != now+offset) {
+			t.Errorf("offset %d: Validate = %d, %v; want ok=%v", offset, step, ok, wantOK)
+		}
+	}
+}
+
+func TestValidateInput(t *testing.T) {
+	at := time.Unix(59, 0)
+	if _, ok := Validate(rfcSecret, " 287 082 ", at); !ok {
+		t.Error("spaces around and inside the code should be ignored")
+	}
+	// The secret is case insensitive, as apps display it either way.
+	if _, ok := Validate(strings.ToLower(rfcSecret), "287082", at); !ok {
+		t.Error("lower-case secret rejected")
+	}
+	for _, code := range []string{"", "28708", "2870820", "abcdef", "287083"} {
+		if _, ok := Validate(rfcSecret, code, at); ok {
+			t.Errorf("Validate accepted %q", code)
+		}
+	}
+	if _, ok := Validate("not base32!", "287082", at); ok {
+		t.Error("Validate accepted an invalid secret")
+	}
+}
+
+func TestNewSecretAndURI(t *testing.T) {
+	a, b := NewSecret(), NewSecret()
+	if a == b || len(a) != 32 {
+		t.Fatalf("NewSecret = %q, %q", a, b)
+	}
+	if _, err := Code(a, 0); err != nil {
+		t.Fatalf("generated secret does not decode: %v", err)
+	}
+
+	u, err := url.Parse(URI("Glooo", "alice@example.test", a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Glooo:alice@example.test" {
+		t.Errorf("unexpected URI %s", u)
+	}
+	if q.Get("secret") != a || q.Get("issuer") != "Glooo" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("unexpected parameters %v", q)
+	}
+}